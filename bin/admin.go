@@ -4,6 +4,11 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tochti/docMa-ctrl/cmds"
 	"github.com/tochti/gin-gum/gumspecs"
@@ -14,90 +19,401 @@ type (
 )
 
 func main() {
-	var newUser bool
-	var createTables bool
-	var migrate bool
-	var docsPath string
-	var txsPath string
-	var cleartxstable bool
 	var debug bool
 
-	flag.BoolVar(&newUser, "newuser", false, "Create new default user")
-	flag.BoolVar(&createTables, "createtables", false, "Create all database tables")
-	flag.BoolVar(&migrate, "migrate", false, "Migrate from mongodb to mysql")
-	flag.BoolVar(&debug, "debug", false, "Enable debugging output")
-	flag.StringVar(&docsPath, "importdocs", "", "Import docs")
-	flag.StringVar(&txsPath, "importtxs", "", "Import accounting transactions")
-	flag.BoolVar(&cleartxstable, "cleartxstable", false, "Clear accounting transaction database table")
+	root := newGroup("docma-admin", "Administration tool for docMa",
+		newGroup("user", "Manage users",
+			userAddCmd(),
+		),
+		newGroup("db", "Manage the MySQL database",
+			dbCreateTablesCmd(),
+			dbClearTxsCmd(),
+		),
+		newGroup("migrate", "Migrate from MongoDB to MySQL",
+			migrateRunCmd(),
+			migrateVerifyCmd(),
+		),
+		newGroup("import", "Import documents and accounting transactions",
+			importDocsCmd(),
+			importTxsCmd(),
+		),
+		newGroup("export", "Export data for older tools",
+			exportMongoCmd(),
+		),
+		watchCmd(),
+		duplicatesCmd(),
+		lookupCmd(),
+	)
+	root.flags = flag.CommandLine
+	root.resolve("")
 
+	flag.BoolVar(&debug, "debug", false, "Enable debugging output")
+	flag.StringVar(&output, "output", output, "Output format text or json")
+	flag.Usage = func() {
+		root.printUsage(os.Stderr)
+	}
 	flag.Parse()
 
+	// -output is a flag of the root only, so it is valid for usage
+	// errors of groups too
+	if output != "text" && output != "json" {
+		msg := fmt.Sprintf("unknown output format %q", output)
+		output = "text"
+		os.Exit(printReport(root, cmds.NewResult(), root.usageErr(msg)))
+	}
+
 	gumspecs.AppName = "docma"
 
 	if !debug {
 		log.SetOutput(blackhole{})
 	}
 
-	if newUser {
-		err := cmds.NewUser()
+	c, result, err := root.execute(flag.Args())
+	if c == nil {
+		return
+	}
+
+	os.Exit(printReport(c, result, err))
+}
+
+func userAddCmd() *command {
+	c := newCommand("add", "", "Create a new user, reads username and password from stdin")
+	c.done = "New user created!"
+	c.run = func(args []string) (cmds.Result, error) {
+		return cmds.NewResult(), cmds.NewUser()
+	}
+
+	return c
+}
+
+func dbCreateTablesCmd() *command {
+	c := newCommand("create-tables", "", "Create all database tables")
+	c.done = "Tables created"
+	c.run = func(args []string) (cmds.Result, error) {
+		return cmds.NewResult(), cmds.CreateTables()
+	}
+
+	return c
+}
+
+func dbClearTxsCmd() *command {
+	c := newCommand("clear-txs", "", "Clear accounting transaction database table")
+	c.done = "Accounting transactions cleared"
+	c.run = func(args []string) (cmds.Result, error) {
+		return cmds.NewResult(), cmds.ClearAccountingTxsTable()
+	}
+
+	return c
+}
+
+func migrateRunCmd() *command {
+	c := newCommand("run", "", "Copy labels, docs and accounting data from MongoDB to MySQL")
+	c.done = "Migration done"
+
+	opts := cmds.MigrateOpts{}
+	c.flags.BoolVar(&opts.Restart, "restart", false, "Remove all migrated data and start over")
+	c.flags.IntVar(&opts.Workers, "workers", 4, "Doc batches written at once")
+	c.flags.IntVar(&opts.BatchSize, "batch-size", 100, "Docs written per transaction")
+	readLabels := labelNormalizerFlags(c, &opts.Labels)
+
+	c.run = func(args []string) (cmds.Result, error) {
+		err := readLabels()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return cmds.NewResult(), err
 		}
 
-		fmt.Println("New user created!")
-		return
+		if output == "text" {
+			opts.Progress = os.Stdout
+		}
+
+		return cmds.Migrate(opts)
 	}
 
-	if createTables {
-		err := cmds.CreateTables()
+	return c
+}
+
+func migrateVerifyCmd() *command {
+	c := newCommand("verify", "", "Compare the migrated data in MySQL with MongoDB")
+	c.done = "No mismatches found"
+
+	n := cmds.LabelNormalizer{}
+	readLabels := labelNormalizerFlags(c, &n)
+
+	c.run = func(args []string) (cmds.Result, error) {
+		err := readLabels()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return cmds.NewResult(), err
 		}
 
-		fmt.Println("Tabels created")
-		return
+		return cmds.VerifyMigration(n)
 	}
 
-	if migrate {
-		err := cmds.Migrate()
+	return c
+}
+
+// labelNormalizerFlags adds the label normalization flags to c. The
+// returned func reads the alias file after the flags are parsed.
+func labelNormalizerFlags(c *command, n *cmds.LabelNormalizer) func() error {
+	c.flags.BoolVar(&n.Trim, "label-trim", false, "Remove white space around label names")
+	c.flags.BoolVar(&n.Fold, "label-fold", false, "Merge label names which only differ in case")
+	c.flags.BoolVar(&n.NFC, "label-nfc", false, "Merge label names which only differ in unicode normalization")
+	aliases := ""
+	c.flags.StringVar(&aliases, "label-aliases", "", "JSON file mapping label names to the label they are merged into")
+
+	return func() error {
+		if aliases == "" {
+			return nil
+		}
+
+		a, err := cmds.ReadLabelAliases(aliases)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return cmds.NewError(cmds.KindConfig, err)
 		}
+		*n = n.WithAliases(a)
 
-		fmt.Println("Migration done")
-		return
+		return nil
 	}
+}
+
+func exportMongoCmd() *command {
+	c := newCommand("mongo", "", "Rebuild the MongoDB docs and accounting data from MySQL")
+	c.done = "Export done"
 
-	if docsPath != "" {
-		err := cmds.ImportDocs(docsPath)
+	opts := cmds.ExportMongoOpts{}
+	to := c.flags.String("to", "mongo", "Write to mongo, bson or json files")
+	c.flags.StringVar(&opts.Dir, "dir", ".", "Directory of the bson or json files")
+
+	c.run = func(args []string) (cmds.Result, error) {
+		var err error
+		opts.Target, err = cmds.ParseExportTarget(*to)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return cmds.NewResult(), c.usageErr(err.Error())
 		}
 
-		fmt.Println("Import done")
-		return
+		return cmds.ExportMongo(opts)
+	}
+
+	return c
+}
+
+func lookupCmd() *command {
+	c := newCommand("lookup", "<id>", "Resolve a MongoDB ObjectId to its MySQL id or back")
+	c.nargs = 1
+
+	kind := ""
+	c.flags.StringVar(&kind, "kind", "", "Only look up docs or accounting_data")
+
+	c.run = func(args []string) (cmds.Result, error) {
+		return cmds.LookupLegacyID(args[0], kind)
+	}
+
+	return c
+}
+
+func importDocsCmd() *command {
+	c := newCommand("docs", "<dir>", "Import scanned documents from a directory")
+	c.nargs = 1
+	c.done = "Import done"
+
+	opts := cmds.ImportDocsOpts{}
+	c.flags.BoolVar(&opts.DryRun, "dry-run", false, "Only print what would be imported")
+	c.flags.IntVar(&opts.ChunkSize, "chunk-size", 0, "Docs written per transaction, 0 writes all docs in one transaction")
+	readOpts := importDocsFlags(c, &opts)
+
+	c.run = func(args []string) (cmds.Result, error) {
+		err := readOpts()
+		if err != nil {
+			return cmds.NewResult(), err
+		}
+
+		if opts.DryRun {
+			c.done = "Dry run done, nothing was written"
+		}
+
+		return cmds.ImportDocs(args[0], opts)
 	}
 
-	if txsPath != "" {
-		err := cmds.ImportAccountingTxs(txsPath)
+	return c
+}
+
+func watchCmd() *command {
+	c := newCommand("watch", "<dir>", "Import new scans in a directory as they arrive, stops on SIGINT or SIGTERM")
+	c.nargs = 1
+	c.done = "Watch stopped"
+
+	opts := cmds.WatchOpts{}
+	readOpts := importDocsFlags(c, &opts.ImportDocsOpts)
+	c.flags.DurationVar(&opts.Settle, "settle", 5*time.Second, "Time a file has to stay unchanged before it is imported")
+	c.flags.DurationVar(&opts.Interval, "interval", time.Second, "Check and poll interval")
+	c.flags.BoolVar(&opts.Poll, "poll", false, "Poll the directory instead of using inotify")
+	c.flags.BoolVar(&opts.Initial, "initial", false, "Import the files already in the directory on start")
+
+	c.run = func(args []string) (cmds.Result, error) {
+		err := readOpts()
+		if err != nil {
+			return cmds.NewResult(), err
+		}
+		if opts.OnInvalidName == cmds.InvalidAbort {
+			return cmds.NewResult(), c.usageErr("-on-invalid-name abort is not supported by watch, use warn or skip")
+		}
+
+		if output == "text" {
+			opts.Progress = os.Stdout
+		}
+
+		stop := make(chan struct{})
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			close(stop)
+		}()
+
+		return cmds.WatchDocs(args[0], opts, stop)
+	}
+
+	return c
+}
+
+func duplicatesCmd() *command {
+	c := newCommand("duplicates", "", "List docs with identical content")
+
+	opts := cmds.ImportDocsOpts{}
+	dir := c.flags.String("hash-dir", "", "Hash the files in this directory for docs imported without hash")
+	readOpts := importDocsFlags(c, &opts)
+
+	c.run = func(args []string) (cmds.Result, error) {
+		err := readOpts()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return cmds.NewResult(), err
 		}
+
+		return cmds.FindDuplicateDocs(*dir, opts)
 	}
 
-	if cleartxstable {
-		err := cmds.ClearAccountingTxsTable()
+	return c
+}
+
+// importDocsFlags adds the flags shared by import docs, watch and
+// duplicates. The returned function has to be called before opts is
+// used.
+func importDocsFlags(c *command, opts *cmds.ImportDocsOpts) func() error {
+	onInvalid := c.flags.String("on-invalid-name", "warn", "What to do with unparseable filenames: warn, skip or abort")
+	schemes := stringList{}
+	c.flags.Var(&schemes, "name-scheme", "Filename scheme default, template:<template> or regexp:<regexp>, can be repeated")
+	schemesFile := c.flags.String("name-schemes", "", "JSON file with filename schemes")
+	c.flags.BoolVar(&opts.Recursive, "recursive", false, "Import files of all subdirectories")
+	c.flags.Var((*stringList)(&opts.Include), "include", "Only import files matching the glob pattern, can be repeated")
+	c.flags.Var((*stringList)(&opts.Exclude), "exclude", "Skip files and directories matching the glob pattern, can be repeated")
+	c.flags.BoolVar(&opts.Hidden, "hidden", false, "Import hidden files and directories")
+	name := c.flags.String("name", "base", "Doc name of files in subdirectories: base or relative")
+	onDuplicate := c.flags.String("on-duplicate", "report", "What to do with files whose content already exists: report or skip")
+	c.flags.Var((*stringList)(&opts.Labels), "label", "Label joined with every doc, can be repeated (default Neu)")
+	c.flags.BoolVar(&opts.CreateLabels, "create-labels", false, "Create missing labels")
+	c.flags.BoolVar(&opts.DirLabels, "dir-labels", false, "Join the subdirectory names of a file as labels")
+	labelRules := c.flags.String("label-rules", "", "JSON file with label rules")
+
+	return func() error {
+		var err error
+		opts.OnInvalidName, err = cmds.ParseInvalidNamePolicy(*onInvalid)
+		if err != nil {
+			return c.usageErr(err.Error())
+		}
+
+		opts.OnDuplicate, err = cmds.ParseDuplicatePolicy(*onDuplicate)
+		if err != nil {
+			return c.usageErr(err.Error())
+		}
+
+		opts.Name, err = cmds.ParseDocNamePolicy(*name)
+		if err != nil {
+			return c.usageErr(err.Error())
+		}
+
+		opts.Parser, err = filenameParser(schemes, *schemesFile)
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
 		}
+
+		if *labelRules != "" {
+			opts.LabelRules, err = cmds.ReadLabelRules(*labelRules)
+			if err != nil {
+				return cmds.NewError(cmds.KindConfig, err)
+			}
+		}
+
+		return nil
+	}
+}
+
+func importTxsCmd() *command {
+	c := newCommand("txs", "<file>", "Import accounting transactions from an export file")
+	c.nargs = 1
+	c.done = "Import done"
+
+	opts := cmds.ImportTxsOpts{Rules: cmds.DefaultTxsRules}
+	onInvalid := c.flags.String("on-invalid", "abort", "Invalid transactions: abort or skip")
+	onDuplicate := c.flags.String("on-duplicate", "update", "Already imported transactions: update or skip")
+	syncTxs := c.flags.Bool("sync", false, "Make the stored transactions equal to the file, deletes missing ones")
+	c.flags.IntVar(&opts.BatchSize, "batch-size", 1000, "Transactions written per statement")
+	c.flags.StringVar(&opts.Format, "format", "", "File format: "+strings.Join(cmds.TxsFormatNames(), ", ")+" (default detected)")
+	c.flags.IntVar(&opts.BankAccount, "bank-account", 1200, "Account of the bank for bank statements")
+	c.flags.IntVar(&opts.ContraAccount, "contra-account", 1590, "Contra account for bank statements")
+	c.flags.StringVar(&opts.RejectsFile, "rejects", "", "File for skipped transactions, default <file>.rejects.csv")
+	c.flags.IntVar(&opts.Rules.MinAccount, "min-account", opts.Rules.MinAccount, "Lowest valid account number")
+	c.flags.IntVar(&opts.Rules.MaxAccount, "max-account", opts.Rules.MaxAccount, "Highest valid account number")
+	c.flags.IntVar(&opts.Rules.MaxTaxCode, "max-tax-code", opts.Rules.MaxTaxCode, "Highest valid tax code")
+	c.flags.Var((*stringList)(&opts.Rules.Currencies), "currency", "Allowed currency, can be repeated, default any ISO code")
+
+	c.run = func(args []string) (cmds.Result, error) {
+		var err error
+		opts.OnInvalid, err = cmds.ParseTxsPolicy(*onInvalid)
+		if err != nil {
+			return cmds.NewResult(), c.usageErr(err.Error())
+		}
+		opts.OnDuplicate, err = cmds.ParseTxsDuplicatePolicy(*onDuplicate)
+		if err != nil {
+			return cmds.NewResult(), c.usageErr(err.Error())
+		}
+
+		if output == "text" {
+			opts.Progress = os.Stdout
+		}
+
+		if *syncTxs {
+			return cmds.SyncAccountingTxs(args[0], opts)
+		}
+
+		return cmds.ImportAccountingTxs(args[0], opts)
+	}
+
+	return c
+}
+
+func filenameParser(schemes []string, file string) (cmds.FilenameParser, error) {
+	l := []cmds.FilenameScheme{}
+	if file != "" {
+		fromFile, err := cmds.ReadFilenameSchemes(file)
+		if err != nil {
+			return nil, cmds.NewError(cmds.KindConfig, err)
+		}
+		l = append(l, fromFile...)
+	}
+
+	for _, s := range schemes {
+		scheme, err := cmds.ParseFilenameScheme(s)
+		if err != nil {
+			return nil, cmds.NewError(cmds.KindConfig, err)
+		}
+		l = append(l, scheme)
+	}
+
+	p, err := cmds.NewFilenameParser(l)
+	if err != nil {
+		return nil, cmds.NewError(cmds.KindConfig, err)
 	}
 
+	return p, nil
 }
 
 func (blackhole) Write(b []byte) (int, error) {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tochti/docMa-ctrl/cmds"
+)
+
+type (
+	// command is a node in the docma-admin command tree. Group commands
+	// only have subs, leaf commands have a run function and their own
+	// flag set.
+	command struct {
+		name  string
+		args  string
+		short string
+		nargs int
+		flags *flag.FlagSet
+		run   func(args []string) (cmds.Result, error)
+		done  string
+		subs  []*command
+		path  string
+	}
+
+	usageError struct {
+		cmd *command
+		msg string
+	}
+
+	// stringList is a flag which can be given multiple times
+	stringList []string
+)
+
+func newCommand(name, args, short string) *command {
+	c := newGroup(name, short)
+	c.args = args
+
+	return c
+}
+
+func newGroup(name, short string, subs ...*command) *command {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	return &command{
+		name:  name,
+		args:  "<command>",
+		short: short,
+		flags: fs,
+		subs:  subs,
+	}
+}
+
+// execute walks down the command tree and runs the matching leaf
+// command. It returns the leaf which was run, or the command which
+// printed its help, together with the leaf's result.
+func (c *command) execute(args []string) (*command, cmds.Result, error) {
+	if len(c.subs) > 0 {
+		if len(args) == 0 {
+			return c, cmds.NewResult(), c.usageErr("missing command")
+		}
+
+		if args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+			c.printUsage(os.Stdout)
+			return nil, cmds.NewResult(), nil
+		}
+
+		if args[0] == "help" {
+			return c.help(args[1:])
+		}
+
+		sub := c.find(args[0])
+		if sub == nil {
+			msg := fmt.Sprintf("unknown command %q", args[0])
+			return c, cmds.NewResult(), c.usageErr(msg)
+		}
+
+		return sub.execute(args[1:])
+	}
+
+	err := c.flags.Parse(args)
+	if err == flag.ErrHelp {
+		c.printUsage(os.Stdout)
+		return nil, cmds.NewResult(), nil
+	}
+	if err != nil {
+		return c, cmds.NewResult(), c.usageErr(err.Error())
+	}
+
+	if c.nargs >= 0 && c.flags.NArg() != c.nargs {
+		msg := fmt.Sprintf("expect %v argument(s) was %v", c.nargs, c.flags.NArg())
+		return c, cmds.NewResult(), c.usageErr(msg)
+	}
+
+	result, err := c.run(c.flags.Args())
+	return c, result, err
+}
+
+// help prints the usage of the command found by names below c.
+func (c *command) help(names []string) (*command, cmds.Result, error) {
+	for _, name := range names {
+		sub := c.find(name)
+		if sub == nil {
+			msg := fmt.Sprintf("unknown command %q", name)
+			return c, cmds.NewResult(), c.usageErr(msg)
+		}
+		c = sub
+	}
+
+	c.printUsage(os.Stdout)
+	return nil, cmds.NewResult(), nil
+}
+
+func (c *command) find(name string) *command {
+	for _, sub := range c.subs {
+		if sub.name == name {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+// resolve sets the full command path of c and all its children,
+// e.g. "docma-admin import docs".
+func (c *command) resolve(parent string) {
+	c.path = strings.TrimSpace(parent + " " + c.name)
+	for _, sub := range c.subs {
+		sub.resolve(c.path)
+	}
+}
+
+func (c *command) usageErr(msg string) error {
+	return usageError{cmd: c, msg: msg}
+}
+
+func (c *command) printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %v", c.path)
+	if c.hasFlags() {
+		fmt.Fprint(w, " [flags]")
+	}
+	if c.args != "" {
+		fmt.Fprintf(w, " %v", c.args)
+	}
+	fmt.Fprintln(w)
+
+	if c.short != "" {
+		fmt.Fprintf(w, "\n%v\n", c.short)
+	}
+
+	if len(c.subs) > 0 {
+		fmt.Fprintln(w, "\nCommands:")
+		for _, sub := range c.subs {
+			fmt.Fprintf(w, "  %-16v %v\n", sub.name, sub.short)
+		}
+	}
+
+	if c.hasFlags() {
+		fmt.Fprintln(w, "\nFlags:")
+		out := c.flags.Output()
+		c.flags.SetOutput(w)
+		c.flags.PrintDefaults()
+		c.flags.SetOutput(out)
+	}
+}
+
+func (c *command) hasFlags() bool {
+	n := 0
+	c.flags.VisitAll(func(*flag.Flag) { n++ })
+
+	return n > 0
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/tochti/docMa-ctrl/cmds"
+)
+
+// Exit codes of docma-admin
+const (
+	exitOK            = 0
+	exitFailure       = 1
+	exitUsage         = 2
+	exitConfig        = 3
+	exitDBConnection  = 4
+	exitParse         = 5
+	exitPartialImport = 6
+	// The report could not be written
+	exitOutput   = 7
+	exitNotFound = 8
+)
+
+type (
+	report struct {
+		Command  string         `json:"command"`
+		Success  bool           `json:"success"`
+		ExitCode int            `json:"exit_code"`
+		Kind     string         `json:"error_kind,omitempty"`
+		Error    string         `json:"error,omitempty"`
+		Counts   map[string]int `json:"counts"`
+		Errors   []string       `json:"errors"`
+		Details  interface{}    `json:"details,omitempty"`
+	}
+)
+
+// Output format of the command result, text or json
+var output = "text"
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	if _, ok := err.(usageError); ok {
+		return exitUsage
+	}
+
+	switch cmds.KindOf(err) {
+	case cmds.KindConfig:
+		return exitConfig
+	case cmds.KindDBConnection:
+		return exitDBConnection
+	case cmds.KindParse:
+		return exitParse
+	case cmds.KindPartialImport:
+		return exitPartialImport
+	case cmds.KindNotFound:
+		return exitNotFound
+	}
+
+	return exitFailure
+}
+
+func newReport(c *command, result cmds.Result, err error) report {
+	r := report{
+		Command:  c.path,
+		Success:  err == nil,
+		ExitCode: exitCode(err),
+		Counts:   result.Counts,
+		Errors:   result.Errors,
+		Details:  result.Details,
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+		if _, ok := err.(usageError); ok {
+			r.Kind = "usage"
+		} else {
+			r.Kind = cmds.KindOf(err).String()
+		}
+	}
+
+	return r
+}
+
+// printReport writes the result of c in the selected output format and
+// returns the exit code.
+func printReport(c *command, result cmds.Result, err error) int {
+	r := newReport(c, result, err)
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err := enc.Encode(r)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot write report: %v\n", err)
+			return exitOutput
+		}
+		return r.ExitCode
+	}
+
+	if uErr, ok := err.(usageError); ok {
+		fmt.Fprintf(os.Stderr, "Error: %v\n\n", uErr.msg)
+		uErr.cmd.printUsage(os.Stderr)
+		return r.ExitCode
+	}
+
+	if s, ok := r.Details.(fmt.Stringer); ok {
+		fmt.Print(s.String())
+	}
+
+	for _, e := range r.Errors {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", e)
+	}
+
+	keys := []string{}
+	for k := range r.Counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%v: %v\n", k, r.Counts[k])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error (%v): %v\n", r.Kind, err)
+		return r.ExitCode
+	}
+
+	if c.done != "" {
+		fmt.Println(c.done)
+	}
+
+	return r.ExitCode
+}
@@ -0,0 +1,205 @@
+package cmds
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/gorp.v1"
+)
+
+const (
+	// MySQL allows at most 65535 placeholders per statement
+	maxPlaceholders = 65535
+	// Used when max_allowed_packet cannot be read from the server
+	defaultMaxPacket = 1000000
+	// Room left in a packet for the protocol overhead
+	packetReserve = 1024
+)
+
+var (
+	maxPacketOnce sync.Once
+	maxPacket     int64
+)
+
+type (
+	// batchStatement is the result of the statement which wrote the
+	// rows First to End-1 of the data of batchInsert.
+	batchStatement struct {
+		First  int
+		End    int
+		Result sql.Result
+	}
+)
+
+// BatchInsert writes data with multi row INSERT statements. values
+// returns the column values of one item in the order of fields.
+//
+// Deprecated: BatchInsert is kept for callers outside of cmds, use a
+// BulkWriter instead.
+func BatchInsert(sqlDB gorp.SqlExecutor, fields []string, data []interface{}, table string, values func(interface{}) []interface{}) error {
+	return batchInsert(sqlDB, "INSERT", "", fields, data, table, values, Chunker{})
+}
+
+// BatchInsertOrIgnore is BatchInsert with INSERT IGNORE.
+//
+// Deprecated: BatchInsertOrIgnore is kept for callers outside of cmds,
+// use a BulkWriter in BulkInsertIgnore mode instead.
+func BatchInsertOrIgnore(sqlDB gorp.SqlExecutor, fields []string, data []interface{}, table string, values func(interface{}) []interface{}) error {
+	return batchInsert(sqlDB, "INSERT IGNORE", "", fields, data, table, values, Chunker{})
+}
+
+// batchInsert splits data into statements which stay within budget.
+// A zero MaxBytes is max_allowed_packet of the server, MaxRows is
+// always capped by the placeholder limit. All values are bound as
+// arguments, suffix is appended to every statement.
+func batchInsert(sqlDB gorp.SqlExecutor, verb, suffix string, fields []string, data []interface{}, table string, values func(interface{}) []interface{}, budget Chunker) error {
+	_, err := batchInsertResults(sqlDB, verb, suffix, fields, data, table, values, budget)
+	return err
+}
+
+// batchInsertResults is batchInsert but returns the result of every
+// statement, e.g. to get the ids of the inserted rows.
+func batchInsertResults(sqlDB gorp.SqlExecutor, verb, suffix string, fields []string, data []interface{}, table string, values func(interface{}) []interface{}, budget Chunker) ([]batchStatement, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	q := fmt.Sprintf("%v INTO %v (%v) VALUES ", verb, table, strings.Join(fields, ","))
+	row := "(" + strings.Repeat("?,", len(fields)-1) + "?)"
+
+	budget = batchBudget(sqlDB, budget, len(fields))
+	budget.Base = len(q) + len(suffix)
+	budget.Sep = 1
+
+	args := make([][]interface{}, len(data))
+	sizes := make([]int, len(data))
+	for i, d := range data {
+		v := values(d)
+		if len(v) != len(fields) {
+			return nil, fmt.Errorf("Expect %v values was %v - %v", len(fields), len(v), v)
+		}
+		args[i] = v
+		sizes[i] = len(row) + argsSize(v)
+	}
+
+	chunks, err := budget.Split(sizes)
+	if err != nil {
+		return nil, err
+	}
+
+	stmts := []batchStatement{}
+	count := 0
+	for _, c := range chunks {
+		n := c.End - c.First
+		e := q + strings.Repeat(row+",", n-1) + row + suffix
+		log.Println(e)
+
+		a := []interface{}{}
+		for _, v := range args[c.First:c.End] {
+			a = append(a, v...)
+		}
+
+		res, err := sqlDB.Exec(e, a...)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, batchStatement{First: c.First, End: c.End, Result: res})
+		count += n
+	}
+
+	if count != len(data) {
+		msg := fmt.Sprintf("Expect %v data was %v - %v", len(data), count, data)
+		return nil, errors.New(msg)
+	}
+
+	return stmts, nil
+}
+
+// batchBudget fills in the defaults of budget for rows with n columns.
+func batchBudget(sqlDB gorp.SqlExecutor, budget Chunker, n int) Chunker {
+	if budget.MaxBytes <= 0 {
+		budget.MaxBytes = int(readMaxPacket(sqlDB)) - packetReserve
+	}
+
+	maxRows := maxPlaceholders / n
+	if budget.MaxRows <= 0 || budget.MaxRows > maxRows {
+		budget.MaxRows = maxRows
+	}
+
+	return budget
+}
+
+// insertedIDs returns the auto increment ids of the n rows written by
+// stmts. InnoDB gives the rows of one insert consecutive ids,
+// LastInsertId is the id of the first row and step is
+// auto_increment_increment.
+func insertedIDs(stmts []batchStatement, n int, step int64) ([]int64, error) {
+	ids := make([]int64, 0, n)
+	for _, s := range stmts {
+		id, err := s.Result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		affected, err := s.Result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if affected != int64(s.End-s.First) {
+			return nil, fmt.Errorf("Expect %v inserted rows was %v", s.End-s.First, affected)
+		}
+
+		for i := s.First; i < s.End; i++ {
+			ids = append(ids, id)
+			id += step
+		}
+	}
+
+	if len(ids) != n {
+		return nil, fmt.Errorf("Expect %v inserted rows was %v", n, len(ids))
+	}
+
+	return ids, nil
+}
+
+// argsSize estimates the bytes the arguments need in a statement.
+func argsSize(args []interface{}) int {
+	n := 0
+	for _, a := range args {
+		switch v := a.(type) {
+		case string:
+			n += len(v)
+		case []byte:
+			n += len(v)
+		case time.Time:
+			n += 26
+		default:
+			n += 8
+		}
+	}
+
+	return n
+}
+
+// readMaxPacket returns max_allowed_packet of the server, it is read
+// only once.
+func readMaxPacket(sqlDB gorp.SqlExecutor) int64 {
+	maxPacketOnce.Do(func() {
+		maxPacket = defaultMaxPacket
+
+		n, err := sqlDB.SelectInt("SELECT @@max_allowed_packet")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if n > 0 {
+			maxPacket = n
+		}
+	})
+
+	return maxPacket
+}
@@ -0,0 +1,206 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+)
+
+// How BulkWriter handles rows whose keys already exist
+const (
+	// BulkInsert fails on duplicate keys
+	BulkInsert BulkMode = iota
+	// BulkInsertIgnore keeps the existing rows
+	BulkInsertIgnore
+	// BulkUpsert updates all non key columns of the existing rows
+	BulkUpsert
+)
+
+var (
+	ErrNoSlice = errors.New("Expect a slice of structs or struct pointers")
+)
+
+type (
+	BulkMode int
+
+	// BulkWriter writes slices of gorp mapped structs with multi row
+	// statements. The columns are read from the table mapping of Map,
+	// an auto increment key is left to the database. The statements
+	// are executed with Exec, e.g. a transaction of Map.
+	BulkWriter struct {
+		Map  *gorp.DbMap
+		Exec gorp.SqlExecutor
+		Mode BulkMode
+		// MaxBytes and MaxRows limit the size of one statement, zero
+		// uses max_allowed_packet and the placeholder limit.
+		MaxBytes int
+		MaxRows  int
+		// Keys are the key fields of the rows as given to SetKeys of
+		// the table, gorp v1 does not export them.
+		Keys     []string
+		AutoIncr bool
+	}
+
+	bulkColumn struct {
+		Name  string
+		Field string
+		Key   bool
+	}
+)
+
+func NewBulkWriter(dbMap *gorp.DbMap, exec gorp.SqlExecutor, mode BulkMode) BulkWriter {
+	if exec == nil {
+		exec = dbMap
+	}
+
+	return BulkWriter{
+		Map:  dbMap,
+		Exec: exec,
+		Mode: mode,
+	}
+}
+
+// SetKeys sets the key fields of the rows like SetKeys of gorp. An auto
+// increment key is not written, other keys are not updated by
+// BulkUpsert.
+func (w BulkWriter) SetKeys(isAutoIncr bool, fieldNames ...string) BulkWriter {
+	w.AutoIncr = isAutoIncr
+	w.Keys = fieldNames
+	return w
+}
+
+// Write inserts all rows, rows has to be a slice of structs or struct
+// pointers of a type added to Map.
+func (w BulkWriter) Write(rows interface{}) error {
+	_, err := w.write(rows)
+	return err
+}
+
+// write is Write but returns the result of every statement.
+func (w BulkWriter) write(rows interface{}) ([]batchStatement, error) {
+	data, err := IfaceSlice(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	t := reflect.TypeOf(rows).Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, ErrNoSlice
+	}
+
+	table, err := w.Map.TableFor(t, false)
+	if err != nil {
+		return nil, err
+	}
+
+	cols, err := bulkColumns(t, table, w.AutoIncr, w.Keys...)
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{}
+	updates := []string{}
+	for _, c := range cols {
+		fields = append(fields, c.Name)
+		if !c.Key {
+			updates = append(updates, fmt.Sprintf("%v=VALUES(%v)", c.Name, c.Name))
+		}
+	}
+
+	verb := "INSERT"
+	suffix := ""
+	switch w.Mode {
+	case BulkInsertIgnore:
+		verb = "INSERT IGNORE"
+	case BulkUpsert:
+		if len(updates) > 0 {
+			suffix = " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+		} else {
+			verb = "INSERT IGNORE"
+		}
+	}
+
+	values := func(i interface{}) []interface{} {
+		v := reflect.Indirect(reflect.ValueOf(i))
+		r := make([]interface{}, len(cols))
+		for x, c := range cols {
+			r[x] = v.FieldByName(c.Field).Interface()
+		}
+		return r
+	}
+
+	budget := Chunker{MaxBytes: w.MaxBytes, MaxRows: w.MaxRows}
+	return batchInsertResults(w.Exec, verb, suffix, fields, data, table.TableName, values, budget)
+}
+
+// bulkColumns returns all columns of table which have to be written
+// with the fields of t they are read from. Columns are matched to
+// fields by their db tag, keys are given like to SetKeys of gorp.
+func bulkColumns(t reflect.Type, table *gorp.TableMap, isAutoIncr bool, keys ...string) ([]bulkColumn, error) {
+	fields := map[string]string{}
+	structColumns(t, fields)
+
+	isKey := map[string]bool{}
+	for _, k := range keys {
+		isKey[k] = true
+	}
+
+	cols := []bulkColumn{}
+	for _, c := range table.Columns {
+		if c.Transient {
+			continue
+		}
+
+		field, ok := fields[c.ColumnName]
+		if !ok {
+			return nil, fmt.Errorf("No field of %v for column %v", t, c.ColumnName)
+		}
+
+		key := isKey[field] || isKey[c.ColumnName]
+		if key && isAutoIncr {
+			continue
+		}
+
+		cols = append(cols, bulkColumn{
+			Name:  c.ColumnName,
+			Field: field,
+			Key:   key,
+		})
+	}
+
+	return cols, nil
+}
+
+// structColumns adds the column names of the fields of t to fields.
+// Fields of embedded structs are added like gorp adds them, a field of
+// t hides a field with the same column of an embedded struct.
+func structColumns(t reflect.Type, fields map[string]string) {
+	embedded := []reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			embedded = append(embedded, f.Type)
+			continue
+		}
+
+		name := f.Tag.Get("db")
+		if name == "" {
+			name = f.Name
+		}
+		if _, ok := fields[name]; !ok {
+			fields[name] = f.Name
+		}
+	}
+
+	for _, e := range embedded {
+		structColumns(e, fields)
+	}
+}
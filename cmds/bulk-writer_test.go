@@ -0,0 +1,48 @@
+package cmds
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/gorp.v1"
+)
+
+type bulkTestRow struct {
+	ID    int64  `db:"id"`
+	Name  string `db:"name"`
+	Cache string `db:"-"`
+}
+
+func Test_BulkColumns(t *testing.T) {
+	dbMap := &gorp.DbMap{Dialect: gorp.MySQLDialect{}}
+	dbMap.AddTableWithName(bulkTestRow{}, "bulk_test").SetKeys(true, "ID")
+
+	table, err := dbMap.TableFor(reflect.TypeOf(bulkTestRow{}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []bulkColumn{{Name: "name", Field: "Name"}}
+	cols, err := bulkColumns(reflect.TypeOf(bulkTestRow{}), table, true, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expect, cols) {
+		t.Fatalf("Expect %v was %v", expect, cols)
+	}
+
+	dbMap.AddTableWithName(bulkTestRow{}, "bulk_test").SetKeys(false, "ID")
+	table, err = dbMap.TableFor(reflect.TypeOf(bulkTestRow{}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect = []bulkColumn{{Name: "id", Field: "ID", Key: true}, {Name: "name", Field: "Name"}}
+	cols, err = bulkColumns(reflect.TypeOf(bulkTestRow{}), table, false, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expect, cols) {
+		t.Fatalf("Expect %v was %v", expect, cols)
+	}
+}
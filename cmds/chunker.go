@@ -0,0 +1,79 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrChunkBudget = errors.New("Chunk budget too small")
+)
+
+type (
+	// Chunker splits a list of items into chunks which stay within a
+	// byte and a row budget. Every chunk costs Base bytes plus the size
+	// of its items plus Sep bytes between two items.
+	Chunker struct {
+		MaxBytes int
+		MaxRows  int
+		Base     int
+		Sep      int
+	}
+
+	// Chunk is the range [First, End) of items.
+	Chunk struct {
+		First int
+		End   int
+		Bytes int
+	}
+
+	// RowSizeError is returned for an item which does not fit into an
+	// empty chunk.
+	RowSizeError struct {
+		Row   int
+		Bytes int
+		Max   int
+	}
+)
+
+func (e *RowSizeError) Error() string {
+	return fmt.Sprintf("Row %v needs %v bytes, only %v allowed", e.Row, e.Bytes, e.Max)
+}
+
+// Split returns the chunks for items with the given sizes. Chunks are
+// filled in order, a new chunk is started before an item which would
+// exceed one of the budgets.
+func (c Chunker) Split(sizes []int) ([]Chunk, error) {
+	if c.MaxRows < 1 || c.MaxBytes <= c.Base {
+		return nil, ErrChunkBudget
+	}
+
+	chunks := []Chunk{}
+	cur := Chunk{Bytes: c.Base}
+	for i, s := range sizes {
+		if c.Base+s > c.MaxBytes {
+			return nil, &RowSizeError{Row: i, Bytes: c.Base + s, Max: c.MaxBytes}
+		}
+
+		n := cur.End - cur.First
+		need := s
+		if n > 0 {
+			need += c.Sep
+		}
+
+		if n > 0 && (n >= c.MaxRows || cur.Bytes+need > c.MaxBytes) {
+			chunks = append(chunks, cur)
+			cur = Chunk{First: i, End: i, Bytes: c.Base}
+			need = s
+		}
+
+		cur.End = i + 1
+		cur.Bytes += need
+	}
+
+	if cur.End > cur.First {
+		chunks = append(chunks, cur)
+	}
+
+	return chunks, nil
+}
@@ -0,0 +1,127 @@
+package cmds
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_Chunker_ExactBoundary(t *testing.T) {
+	c := Chunker{MaxBytes: 30, MaxRows: 10, Base: 10, Sep: 1}
+
+	// 10 + 9 + 1 + 9 = 29, 1 byte left
+	chunks, err := c.Split([]int{9, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Chunk{{First: 0, End: 2, Bytes: 29}}
+	if !reflect.DeepEqual(expect, chunks) {
+		t.Fatalf("Expect %v was %v", expect, chunks)
+	}
+
+	// 10 + 9 + 1 + 10 = 30 fits exactly
+	chunks, err = c.Split([]int{9, 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []Chunk{{First: 0, End: 2, Bytes: 30}}
+	if !reflect.DeepEqual(expect, chunks) {
+		t.Fatalf("Expect %v was %v", expect, chunks)
+	}
+
+	// One byte more starts a new chunk which counts its first row
+	chunks, err = c.Split([]int{9, 11, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []Chunk{
+		{First: 0, End: 1, Bytes: 19},
+		{First: 1, End: 3, Bytes: 27},
+	}
+	if !reflect.DeepEqual(expect, chunks) {
+		t.Fatalf("Expect %v was %v", expect, chunks)
+	}
+
+	// A row filling the whole budget
+	chunks, err = c.Split([]int{20, 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = []Chunk{
+		{First: 0, End: 1, Bytes: 30},
+		{First: 1, End: 2, Bytes: 30},
+	}
+	if !reflect.DeepEqual(expect, chunks) {
+		t.Fatalf("Expect %v was %v", expect, chunks)
+	}
+}
+
+func Test_Chunker_SingleHugeRow(t *testing.T) {
+	c := Chunker{MaxBytes: 30, MaxRows: 10, Base: 10, Sep: 1}
+
+	_, err := c.Split([]int{5, 21, 5})
+	expect := &RowSizeError{Row: 1, Bytes: 31, Max: 30}
+	if !reflect.DeepEqual(expect, err) {
+		t.Fatalf("Expect %v was %v", expect, err)
+	}
+
+	_, err = c.Split([]int{21})
+	if err == nil {
+		t.Fatalf("Expect %v was %v", "error", err)
+	}
+}
+
+func Test_Chunker_ManySmallRows(t *testing.T) {
+	sizes := make([]int, 1000)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+
+	// Limited by rows
+	c := Chunker{MaxBytes: 1000000, MaxRows: 300, Base: 10, Sep: 1}
+	chunks, err := c.Split(sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 4 {
+		t.Fatalf("Expect %v was %v", 4, len(chunks))
+	}
+	last := Chunk{First: 900, End: 1000, Bytes: 10 + 100 + 99}
+	if chunks[3] != last {
+		t.Fatalf("Expect %v was %v", last, chunks[3])
+	}
+
+	// Limited by bytes, 10 + 50 rows + 49 separators = 109
+	c = Chunker{MaxBytes: 109, MaxRows: 300, Base: 10, Sep: 1}
+	chunks, err = c.Split(sizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 20 {
+		t.Fatalf("Expect %v was %v", 20, len(chunks))
+	}
+
+	n := 0
+	for i, ch := range chunks {
+		if ch.First != n || ch.End-ch.First != 50 || ch.Bytes != 109 {
+			t.Fatalf("Expect %v was %v", Chunk{n, n + 50, 109}, chunks[i])
+		}
+		n = ch.End
+	}
+}
+
+func Test_Chunker_Budget(t *testing.T) {
+	for _, c := range []Chunker{
+		{MaxBytes: 10, MaxRows: 10, Base: 10},
+		{MaxBytes: 100, MaxRows: 0},
+	} {
+		_, err := c.Split([]int{1})
+		if err != ErrChunkBudget {
+			t.Fatalf("Expect %v was %v", ErrChunkBudget, err)
+		}
+	}
+
+	chunks, err := Chunker{MaxBytes: 100, MaxRows: 1}.Split(nil)
+	if err != nil || len(chunks) != 0 {
+		t.Fatalf("Expect %v was %v", []Chunk{}, chunks)
+	}
+}
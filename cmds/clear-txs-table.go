@@ -4,13 +4,25 @@ import (
 	"fmt"
 
 	"github.com/tochti/docMa-handler/accountingData"
-	"github.com/tochti/docMa-handler/common"
 )
 
 func ClearAccountingTxsTable() error {
-	db := common.InitMySQL()
+	db, err := openMySQL()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("TRUNCATE TABLE %v", accountingData.AccountingDataTable))
+	if err != nil {
+		return err
+	}
+
+	err = CreateCtrlTables(db)
+	if err != nil {
+		return err
+	}
 
-	_, err := db.Exec(fmt.Sprintf("TRUNCATE TABLE %v", accountingData.AccountingDataTable))
+	_, err = db.Exec(fmt.Sprintf("TRUNCATE TABLE %v", TxsKeysTable))
 	if err != nil {
 		return err
 	}
@@ -2,7 +2,6 @@ package cmds
 
 import (
 	"github.com/tochti/docMa-handler/accountingData"
-	"github.com/tochti/docMa-handler/common"
 	"github.com/tochti/docMa-handler/dbVars"
 	"github.com/tochti/docMa-handler/docs"
 	"github.com/tochti/docMa-handler/labels"
@@ -10,7 +9,10 @@ import (
 )
 
 func CreateTables() error {
-	db := common.InitMySQL()
+	db, err := openMySQL()
+	if err != nil {
+		return err
+	}
 
 	gumauth.AddTables(db)
 	dbVars.AddTables(db)
@@ -18,7 +20,12 @@ func CreateTables() error {
 	labels.AddTables(db)
 	accountingData.AddTables(db)
 
-	err := db.CreateTablesIfNotExists()
+	err = db.CreateTablesIfNotExists()
+	if err != nil {
+		return err
+	}
+
+	err = CreateCtrlTables(db)
 	if err != nil {
 		return err
 	}
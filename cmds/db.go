@@ -0,0 +1,19 @@
+package cmds
+
+import (
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/common"
+)
+
+// openMySQL connects to MySQL and makes sure the server is reachable.
+func openMySQL() (*gorp.DbMap, error) {
+	db := common.InitMySQL()
+
+	err := db.Db.Ping()
+	if err != nil {
+		return nil, NewError(KindDBConnection, err)
+	}
+
+	return db, nil
+}
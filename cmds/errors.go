@@ -0,0 +1,87 @@
+package cmds
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// KindUnknown is used for all errors without a more specific kind
+	KindUnknown ErrorKind = iota
+	// KindConfig signals a missing or invalid configuration, e.g. env
+	// variables, input paths or required database rows
+	KindConfig
+	// KindDBConnection signals that MySQL or MongoDB could not be reached
+	KindDBConnection
+	// KindParse signals input data which could not be parsed
+	KindParse
+	// KindPartialImport signals that a command failed after it already
+	// wrote data, the database has to be checked before a rerun
+	KindPartialImport
+	// KindNotFound signals that a looked up object does not exist
+	KindNotFound
+)
+
+type (
+	ErrorKind int
+
+	// Error wraps an error with the kind of failure so the caller can
+	// decide how to report it.
+	Error struct {
+		Kind ErrorKind
+		Err  error
+	}
+)
+
+func NewError(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &Error{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of err, KindUnknown if err is not an *Error.
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+
+	return KindUnknown
+}
+
+// partialErr marks err as partial import if n items were already
+// written.
+func partialErr(n int, err error) error {
+	if err == nil || n == 0 {
+		return err
+	}
+
+	return NewError(KindPartialImport, fmt.Errorf("%v items written before error: %v", n, err))
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindConfig:
+		return "config"
+	case KindDBConnection:
+		return "db_connection"
+	case KindParse:
+		return "parse"
+	case KindPartialImport:
+		return "partial_import"
+	case KindNotFound:
+		return "not_found"
+	}
+
+	return "unknown"
+}
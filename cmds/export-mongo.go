@@ -0,0 +1,468 @@
+package cmds
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/tochti/docMa-handler/accountingData"
+	"github.com/tochti/docMa-handler/docs"
+	"github.com/tochti/docMa-handler/labels"
+)
+
+// Where ExportMongo writes the documents
+const (
+	// ExportMongoDB upserts into the MongoDB of the environment
+	ExportMongoDB ExportTarget = iota
+	// ExportBSON writes files in the format of mongodump
+	ExportBSON
+	// ExportJSON writes one document per line in the extended JSON of
+	// mongoexport, e.g. {"_id": {"$oid": ...}, "date": {"$date": ...}}
+	ExportJSON
+)
+
+// Number of MySQL rows exported per page
+const exportBatchSize = 1000
+
+type (
+	ExportTarget int
+
+	ExportMongoOpts struct {
+		Target ExportTarget
+		// Dir gets one file per collection for the file targets
+		Dir string
+	}
+
+	// exportFiles writes the documents of each collection to a file of
+	// its own.
+	exportFiles struct {
+		target ExportTarget
+		files  map[string]*os.File
+		bufs   map[string]*bufio.Writer
+	}
+)
+
+// ExportMongo rebuilds the Doc and AccProcess documents of the old
+// MongoDB schema from MySQL. Objects which were migrated keep their
+// ObjectId, all others get a new one. The MongoDB target saves the new
+// ids in the legacy ids table, so a second export writes the same ids.
+// The file targets do not write to MySQL, their new ids change with
+// every export. MySQL is read in pages by id, each page is written
+// before the next one is read.
+func ExportMongo(opts ExportMongoOpts) (Result, error) {
+	result := NewResult()
+
+	sqlDB, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
+	docs.AddTables(sqlDB)
+	labels.AddTables(sqlDB)
+	accountingData.AddTables(sqlDB)
+
+	saveIDs := opts.Target == ExportMongoDB
+	if saveIDs {
+		err = CreateCtrlTables(sqlDB)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	switch opts.Target {
+	case ExportMongoDB:
+		mgoSession, mgoSpecs, err := dialMongoDB()
+		if err != nil {
+			return result, err
+		}
+		defer mgoSession.Close()
+
+		err = exportAll(sqlDB, saveIDs, exportToMongoDB(mgoSession.DB(mgoSpecs.DBName)), &result)
+		return result, err
+	case ExportBSON, ExportJSON:
+		files, err := createExportFiles(opts, DocsColl, AccountingDataColl)
+		if err != nil {
+			return result, err
+		}
+
+		err = exportAll(sqlDB, saveIDs, files.write, &result)
+		cErr := files.close()
+		if err != nil {
+			return result, err
+		}
+		return result, cErr
+	}
+
+	return result, NewError(KindConfig, fmt.Errorf("Unknown export target %v", opts.Target))
+}
+
+// exportAll passes the docs and the accounting data to write and counts
+// them in result.
+func exportAll(sqlDB *gorp.DbMap, saveIDs bool, write func(string, []interface{}) error, result *Result) error {
+	n, err := exportDocs(sqlDB, saveIDs, func(d []interface{}) error {
+		return write(DocsColl, d)
+	})
+	result.Add("docs", n)
+	if err != nil {
+		return err
+	}
+
+	n, err = exportAccountingData(sqlDB, saveIDs, func(d []interface{}) error {
+		return write(AccountingDataColl, d)
+	})
+	result.Add("accounting_data", n)
+
+	return err
+}
+
+// exportDocs passes the docs of MySQL page by page to write and
+// returns the number of written docs.
+func exportDocs(sqlDB *gorp.DbMap, saveIDs bool, write func([]interface{}) error) (int, error) {
+	n := 0
+	afterID := int64(0)
+	for {
+		sDocs, err := readExportDocPage(sqlDB, afterID)
+		if err != nil || len(sDocs) == 0 {
+			return n, err
+		}
+		afterID = sDocs[len(sDocs)-1].Doc.ID
+
+		ids := []int64{}
+		for _, d := range sDocs {
+			ids = append(ids, d.Doc.ID)
+		}
+		objectIDs, err := exportObjectIDs(sqlDB, StageDocs, ids, saveIDs)
+		if err != nil {
+			return n, err
+		}
+
+		data := []interface{}{}
+		for _, d := range sDocs {
+			data = append(data, toMongoDoc(d, objectIDs[d.Doc.ID]))
+		}
+		err = write(data)
+		if err != nil {
+			return n, err
+		}
+		n += len(data)
+	}
+}
+
+// readExportDocPage returns the next exportBatchSize docs of MySQL
+// after afterID with their rows, empty after the last page.
+func readExportDocPage(db gorp.SqlExecutor, afterID int64) ([]*migratedDoc, error) {
+	dd := []*migratedDoc{}
+	q := fmt.Sprintf("SELECT * FROM %v WHERE id>? ORDER BY id LIMIT ?", docs.DocsTable)
+	_, err := db.Select(&dd, q, afterID, exportBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return dd, readDocRows(db, dd)
+}
+
+// exportAccountingData is exportDocs for the accounting data.
+func exportAccountingData(sqlDB *gorp.DbMap, saveIDs bool, write func([]interface{}) error) (int, error) {
+	n := 0
+	afterID := int64(0)
+	q := fmt.Sprintf("SELECT * FROM %v WHERE id>? ORDER BY id LIMIT ?", accountingData.AccountingDataTable)
+	for {
+		sAcc := []accountingData.AccountingData{}
+		_, err := sqlDB.Select(&sAcc, q, afterID, exportBatchSize)
+		if err != nil || len(sAcc) == 0 {
+			return n, err
+		}
+		afterID = sAcc[len(sAcc)-1].ID
+
+		ids := []int64{}
+		for _, a := range sAcc {
+			ids = append(ids, a.ID)
+		}
+		objectIDs, err := exportObjectIDs(sqlDB, StageAccountingData, ids, saveIDs)
+		if err != nil {
+			return n, err
+		}
+
+		data := []interface{}{}
+		for _, a := range sAcc {
+			data = append(data, toAccProcess(a, objectIDs[a.ID]))
+		}
+		err = write(data)
+		if err != nil {
+			return n, err
+		}
+		n += len(data)
+	}
+}
+
+// exportObjectIDs returns the ObjectIds of the MySQL ids of kind. Ids
+// without a legacy id get a new one, which is saved if save is true.
+func exportObjectIDs(sqlDB *gorp.DbMap, kind string, ids []int64, save bool) (map[int64]bson.ObjectId, error) {
+	rows := []struct {
+		MongoID string `db:"mongo_id"`
+		MySQLID int64  `db:"mysql_id"`
+	}{}
+	ok, err := ctrlTableExists(sqlDB, LegacyIDsTable)
+	if err != nil {
+		return nil, err
+	}
+	if ok && len(ids) > 0 {
+		q := fmt.Sprintf("SELECT mongo_id, mysql_id FROM %v WHERE kind=? AND mysql_id IN (%v)",
+			LegacyIDsTable, placeholders(len(ids)))
+		args := []interface{}{kind}
+		for _, id := range ids {
+			args = append(args, id)
+		}
+		_, err := sqlDB.Select(&rows, q, args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := map[int64]bson.ObjectId{}
+	for _, row := range rows {
+		if bson.IsObjectIdHex(row.MongoID) {
+			r[row.MySQLID] = bson.ObjectIdHex(row.MongoID)
+		}
+	}
+
+	legacy := []LegacyID{}
+	for _, id := range ids {
+		if _, ok := r[id]; ok {
+			continue
+		}
+
+		r[id] = bson.NewObjectId()
+		legacy = append(legacy, LegacyID{Kind: kind, MongoID: r[id].Hex(), MySQLID: id})
+	}
+	if !save {
+		return r, nil
+	}
+
+	return r, saveLegacyIDs(sqlDB, legacy)
+}
+
+// toMongoDoc rebuilds the doc d. Doc numbers and labels are sorted, so
+// an export of the same rows is the same.
+func toMongoDoc(d *migratedDoc, id bson.ObjectId) Doc {
+	numbers := append([]string{}, d.Numbers...)
+	sort.Strings(numbers)
+	docLabels := append([]string{}, d.Labels...)
+	sort.Strings(docLabels)
+
+	return Doc{
+		ID:      id,
+		Name:    d.Doc.Name,
+		Barcode: d.Doc.Barcode,
+		Infos: DocInfos{
+			DateOfScan:    d.Doc.DateOfScan,
+			DateOfReceipt: d.Doc.DateOfReceipt,
+		},
+		Note: DocNote(d.Doc.Note),
+		AccountData: DocAccountData{
+			DocNumbers: numbers,
+			AccNumber:  d.AccountData.AccountNumber,
+			DocPeriod: DocPeriod{
+				From: d.AccountData.PeriodFrom,
+				To:   d.AccountData.PeriodTo,
+			},
+		},
+		Labels: docLabels,
+	}
+}
+
+func toAccProcess(a accountingData.AccountingData, id bson.ObjectId) AccProcess {
+	return AccProcess{
+		ID:               id,
+		DocDate:          a.DocDate,
+		DateOfEntry:      a.DateOfEntry,
+		DocNumberRange:   a.DocNumberRange,
+		DocNumber:        a.DocNumber,
+		PostingText:      a.PostingText,
+		AmountPosted:     a.AmountPosted,
+		DebitAcc:         a.DebitAccount,
+		CreditAcc:        a.CreditAccount,
+		TaxCode:          a.TaxCode,
+		CostUnit1:        a.CostUnit1,
+		CostUnit2:        a.CostUnit2,
+		AmountPostedEuro: a.AmountPostedEuro,
+		Currency:         a.Currency,
+	}
+}
+
+// exportToMongoDB returns a write function which upserts the documents
+// into the collections of mgoDB.
+func exportToMongoDB(mgoDB *mgo.Database) func(string, []interface{}) error {
+	return func(coll string, data []interface{}) error {
+		c := mgoDB.C(coll)
+		for _, d := range data {
+			var id bson.ObjectId
+			switch v := d.(type) {
+			case Doc:
+				id = v.ID
+			case AccProcess:
+				id = v.ID
+			default:
+				return fmt.Errorf("Unknown export document %T", d)
+			}
+
+			_, err := c.UpsertId(id, d)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// createExportFiles creates one file per collection in opts.Dir.
+func createExportFiles(opts ExportMongoOpts, colls ...string) (*exportFiles, error) {
+	err := os.MkdirAll(opts.Dir, 0755)
+	if err != nil {
+		return nil, NewError(KindConfig, err)
+	}
+
+	ext := ".bson"
+	if opts.Target == ExportJSON {
+		ext = ".json"
+	}
+
+	f := &exportFiles{
+		target: opts.Target,
+		files:  map[string]*os.File{},
+		bufs:   map[string]*bufio.Writer{},
+	}
+	for _, coll := range colls {
+		fh, err := os.Create(filepath.Join(opts.Dir, coll+ext))
+		if err != nil {
+			f.close()
+			return nil, err
+		}
+		f.files[coll] = fh
+		f.bufs[coll] = bufio.NewWriter(fh)
+	}
+
+	return f, nil
+}
+
+func (f *exportFiles) write(coll string, data []interface{}) error {
+	return writeExport(f.bufs[coll], f.target, data)
+}
+
+// close flushes and closes all files, it returns the first error.
+func (f *exportFiles) close() error {
+	var r error
+	for coll, fh := range f.files {
+		err := f.bufs[coll].Flush()
+		cErr := fh.Close()
+		if err == nil {
+			err = cErr
+		}
+		if r == nil {
+			r = err
+		}
+	}
+
+	return r
+}
+
+// writeExport writes data as concatenated BSON documents or as one
+// extended JSON document per line. JSON documents use the BSON field
+// names in the order of the BSON documents.
+func writeExport(w io.Writer, target ExportTarget, data []interface{}) error {
+	for _, d := range data {
+		b, err := bson.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		if target == ExportJSON {
+			doc := bson.D{}
+			err := bson.Unmarshal(b, &doc)
+			if err != nil {
+				return err
+			}
+
+			buf := &bytes.Buffer{}
+			err = writeExportJSON(buf, doc)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte('\n')
+			b = buf.Bytes()
+		}
+
+		_, err = w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeExportJSON writes v as extended JSON. bson.MarshalJSON does not
+// write a bson.D as object, so documents and arrays are written here and
+// only their values by bson.MarshalJSON.
+func writeExportJSON(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case bson.D:
+		buf.WriteByte('{')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeExportJSON(buf, e.Name)
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			err = writeExportJSON(buf, e.Value)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			err := writeExportJSON(buf, e)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	default:
+		b, err := bson.MarshalJSON(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(bytes.TrimSuffix(b, []byte("\n")))
+	}
+
+	return nil
+}
+
+func ParseExportTarget(s string) (ExportTarget, error) {
+	switch s {
+	case "mongo":
+		return ExportMongoDB, nil
+	case "bson":
+		return ExportBSON, nil
+	case "json":
+		return ExportJSON, nil
+	}
+
+	return ExportMongoDB, fmt.Errorf("Unknown export target %v", s)
+}
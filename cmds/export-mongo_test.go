@@ -0,0 +1,91 @@
+package cmds
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/tochti/docMa-handler/docs"
+)
+
+func Test_ToMongoDoc(t *testing.T) {
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	id := bson.NewObjectId()
+	m := &migratedDoc{
+		Doc:         docs.Doc{1, "Name-1", "Barcode-1", d, d, "Note-1"},
+		AccountData: docs.DocAccountData{1, d, d, 1400},
+		Numbers:     []string{"DN2", "DN1"},
+		Labels:      []string{"l2", "l1"},
+	}
+
+	r := toMongoDoc(m, id)
+	if r.ID != id ||
+		r.Name != "Name-1" ||
+		r.Note != DocNote("Note-1") ||
+		!r.Infos.DateOfScan.Equal(d) ||
+		r.AccountData.AccNumber != 1400 ||
+		!r.AccountData.DocPeriod.To.Equal(d) ||
+		strings.Join(r.AccountData.DocNumbers, ",") != "DN1,DN2" ||
+		strings.Join(r.Labels, ",") != "l1,l2" {
+		t.Fatalf("Expect %v was %v", m, r)
+	}
+}
+
+func Test_WriteExport(t *testing.T) {
+	id := bson.NewObjectId()
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	data := []interface{}{
+		Doc{ID: id, Name: "Name-1", Labels: []string{"l1"}, Infos: DocInfos{DateOfScan: d}},
+	}
+
+	buf := &bytes.Buffer{}
+	err := writeExport(buf, ExportJSON, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := buf.String()
+	for _, expect := range []string{
+		fmt.Sprintf(`"_id":{"$oid":"%v"}`, id.Hex()),
+		`"dateofscan":{"$date":"2014-01-01T00:00:00Z"}`,
+	} {
+		if !strings.Contains(line, expect) {
+			t.Fatalf("Expect %v was %v", expect, line)
+		}
+	}
+	expect := fmt.Sprintf(`{"_id":{"$oid":"%v"},"name":"Name-1",`, id.Hex())
+	if !strings.HasPrefix(line, expect) || strings.Index(line, `"infos"`) > strings.Index(line, `"labels"`) {
+		t.Fatalf("Expect %v was %v", "fields in struct order", line)
+	}
+	if !strings.HasSuffix(line, "}\n") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("Expect %v was %q", "one line", line)
+	}
+
+	m := Doc{}
+	err = bson.UnmarshalJSON(buf.Bytes(), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "Name-1" {
+		t.Fatalf("Expect %v was %v", data[0], m)
+	}
+
+	buf.Reset()
+	err = writeExport(buf, ExportBSON, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := Doc{}
+	err = bson.Unmarshal(buf.Bytes(), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != id || r.Name != "Name-1" {
+		t.Fatalf("Expect %v was %v", data[0], r)
+	}
+}
@@ -0,0 +1,343 @@
+package cmds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrFilenameFormat = errors.New("Wrong filename format")
+)
+
+// Reasons why ParseFilename rejects a filename
+const (
+	ReasonSegments      = "wrong segment count"
+	ReasonDateLength    = "bad date length"
+	ReasonDate          = "invalid date"
+	ReasonMonth         = "invalid month"
+	ReasonDay           = "invalid day"
+	ReasonBarcodeLength = "bad barcode length"
+)
+
+type (
+	// FilenameError describes why a filename could not be parsed.
+	// errors.Is(err, ErrFilenameFormat) is true for every FilenameError.
+	FilenameError struct {
+		Name   string
+		Reason string
+	}
+)
+
+func ParseFilename(n string) (time.Time, string, error) {
+	filename := n
+	ext := path.Ext(n)
+	if len(ext) > 0 {
+		n = strings.Replace(n, ext, "", -1)
+	}
+	r := strings.Split(n, "_")
+	zeroDate := time.Time{}
+
+	if len(r) != 2 {
+		return zeroDate, "", &FilenameError{filename, ReasonSegments}
+	}
+	if len(r[0]) != 8 {
+		return zeroDate, "", &FilenameError{filename, ReasonDateLength}
+	}
+	if len(r[1]) != 7 {
+		return zeroDate, "", &FilenameError{filename, ReasonBarcodeLength}
+	}
+
+	year, err := strconv.ParseInt(r[0][0:4], 10, 32)
+	if err != nil {
+		return zeroDate, "", &FilenameError{filename, ReasonDate}
+	}
+	month, err := strconv.ParseInt(r[0][4:6], 10, 32)
+	if err != nil || month < 1 || month > 12 {
+		return zeroDate, "", &FilenameError{filename, ReasonMonth}
+	}
+	day, err := strconv.ParseInt(r[0][6:8], 10, 32)
+	if err != nil {
+		return zeroDate, "", &FilenameError{filename, ReasonDay}
+	}
+	date := time.Date(int(year), time.Month(int(month)), int(day), 0, 0, 0, 0, time.Local)
+	// time.Date normalizes days out of range e.g. 31.02 becomes 03.03
+	if day < 1 || date.Day() != int(day) {
+		return zeroDate, "", &FilenameError{filename, ReasonDay}
+	}
+
+	id := r[1]
+
+	return date, id, nil
+}
+
+func (e *FilenameError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrFilenameFormat, e.Reason)
+}
+
+func (e *FilenameError) Unwrap() error {
+	return ErrFilenameFormat
+}
+
+// Reasons used by the configurable filename parsers
+const (
+	ReasonNoMatch = "matches no filename scheme"
+	ReasonBarcode = "missing barcode"
+)
+
+type (
+	// FilenameParser reads the scan date and the barcode from the
+	// filename of a document.
+	FilenameParser interface {
+		Parse(filename string) (time.Time, string, error)
+	}
+
+	// DefaultParser parses the YYYYMMDD_NNNNNNN.ext layout, see
+	// ParseFilename.
+	DefaultParser struct{}
+
+	// RegexpParser matches the filename without extension against a
+	// regular expression with the named groups date and barcode. The
+	// date group is parsed with DateLayout.
+	RegexpParser struct {
+		Regexp     *regexp.Regexp
+		DateLayout string
+	}
+
+	// MultiParser tries all parsers in order and uses the first match.
+	MultiParser []FilenameParser
+
+	// FilenameScheme is the configuration of a filename parser. Only
+	// one of Template and Regexp is used, without both the default
+	// layout is parsed.
+	//
+	// A template is the filename without extension where {date:LAYOUT}
+	// is a date in Go time layout, {barcode} or {barcode:N} the barcode
+	// with any or exactly N letters and digits and {*} matches
+	// anything, e.g. "SCAN{*}_{date:2006-01-02}_{barcode:10}".
+	FilenameScheme struct {
+		Name       string `json:"name"`
+		Template   string `json:"template"`
+		Regexp     string `json:"regexp"`
+		DateLayout string `json:"date_layout"`
+	}
+
+	filenameSchemesFile struct {
+		Schemes []FilenameScheme `json:"schemes"`
+	}
+)
+
+var (
+	templateVarRegexp = regexp.MustCompile(`\{(date|barcode|\*)(?::([^}]+))?\}`)
+	layoutTokens      = []string{"2006", "01", "02", "06", "15", "04", "05"}
+)
+
+func (DefaultParser) Parse(filename string) (time.Time, string, error) {
+	return ParseFilename(filename)
+}
+
+func NewRegexpParser(expr, dateLayout string) (RegexpParser, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return RegexpParser{}, err
+	}
+
+	hasDate, hasBarcode := false, false
+	for _, n := range re.SubexpNames() {
+		hasDate = hasDate || n == "date"
+		hasBarcode = hasBarcode || n == "barcode"
+	}
+	if !hasDate || !hasBarcode {
+		return RegexpParser{}, fmt.Errorf("Regexp %v needs the groups date and barcode", expr)
+	}
+
+	if dateLayout == "" {
+		dateLayout = "20060102"
+	}
+
+	return RegexpParser{Regexp: re, DateLayout: dateLayout}, nil
+}
+
+// NewTemplateParser compiles a filename template, see FilenameScheme.
+func NewTemplateParser(tpl string) (RegexpParser, error) {
+	expr := bytes.NewBufferString("^")
+	layout := ""
+	last := 0
+	for _, m := range templateVarRegexp.FindAllStringSubmatchIndex(tpl, -1) {
+		expr.WriteString(regexp.QuoteMeta(tpl[last:m[0]]))
+		last = m[1]
+
+		arg := ""
+		if m[4] >= 0 {
+			arg = tpl[m[4]:m[5]]
+		}
+
+		switch tpl[m[2]:m[3]] {
+		case "date":
+			if arg == "" {
+				arg = "20060102"
+			}
+			layout = arg
+			expr.WriteString("(?P<date>" + layoutRegexp(arg) + ")")
+		case "barcode":
+			if arg == "" {
+				expr.WriteString("(?P<barcode>[0-9A-Za-z]+)")
+				break
+			}
+			n, err := strconv.Atoi(arg)
+			if err != nil {
+				return RegexpParser{}, fmt.Errorf("Bad barcode length %v in template %v", arg, tpl)
+			}
+			expr.WriteString(fmt.Sprintf("(?P<barcode>[0-9A-Za-z]{%v})", n))
+		case "*":
+			expr.WriteString(".*?")
+		}
+	}
+	expr.WriteString(regexp.QuoteMeta(tpl[last:]))
+	expr.WriteString("$")
+
+	return NewRegexpParser(expr.String(), layout)
+}
+
+// layoutRegexp turns a numeric Go time layout into a regular expression,
+// e.g. 2006-01-02 into \d{4}-\d{2}-\d{2}.
+func layoutRegexp(layout string) string {
+	buf := &bytes.Buffer{}
+	for len(layout) > 0 {
+		found := false
+		for _, t := range layoutTokens {
+			if strings.HasPrefix(layout, t) {
+				buf.WriteString(fmt.Sprintf(`\d{%v}`, len(t)))
+				layout = layout[len(t):]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			buf.WriteString(regexp.QuoteMeta(layout[:1]))
+			layout = layout[1:]
+		}
+	}
+
+	return buf.String()
+}
+
+func (p RegexpParser) Parse(filename string) (time.Time, string, error) {
+	n := strings.TrimSuffix(filename, path.Ext(filename))
+	zeroDate := time.Time{}
+
+	m := p.Regexp.FindStringSubmatch(n)
+	if m == nil {
+		return zeroDate, "", &FilenameError{filename, ReasonNoMatch}
+	}
+
+	date, barcode := "", ""
+	for i, name := range p.Regexp.SubexpNames() {
+		switch name {
+		case "date":
+			date = m[i]
+		case "barcode":
+			barcode = m[i]
+		}
+	}
+
+	if barcode == "" {
+		return zeroDate, "", &FilenameError{filename, ReasonBarcode}
+	}
+
+	d, err := time.ParseInLocation(p.DateLayout, date, time.Local)
+	if err != nil {
+		return zeroDate, "", &FilenameError{filename, ReasonDate}
+	}
+
+	return d, barcode, nil
+}
+
+// Parse returns the result of the first parser which accepts the
+// filename. With a single parser its error is returned unchanged.
+func (ps MultiParser) Parse(filename string) (time.Time, string, error) {
+	var err error
+	for _, p := range ps {
+		date, barcode, pErr := p.Parse(filename)
+		if pErr == nil {
+			return date, barcode, nil
+		}
+		err = pErr
+	}
+
+	if len(ps) != 1 {
+		err = &FilenameError{filename, ReasonNoMatch}
+	}
+
+	return time.Time{}, "", err
+}
+
+func (s FilenameScheme) Parser() (FilenameParser, error) {
+	switch {
+	case s.Template != "":
+		return NewTemplateParser(s.Template)
+	case s.Regexp != "":
+		return NewRegexpParser(s.Regexp, s.DateLayout)
+	}
+
+	return DefaultParser{}, nil
+}
+
+// ParseFilenameScheme reads a scheme from the command line, either
+// "default", "template:<template>" or "regexp:<regexp>".
+func ParseFilenameScheme(s string) (FilenameScheme, error) {
+	switch {
+	case s == "default":
+		return FilenameScheme{Name: s}, nil
+	case strings.HasPrefix(s, "template:"):
+		return FilenameScheme{Name: s, Template: strings.TrimPrefix(s, "template:")}, nil
+	case strings.HasPrefix(s, "regexp:"):
+		return FilenameScheme{Name: s, Regexp: strings.TrimPrefix(s, "regexp:")}, nil
+	}
+
+	return FilenameScheme{}, fmt.Errorf("Unknown filename scheme %v", s)
+}
+
+// ReadFilenameSchemes reads a JSON file of the form
+// {"schemes": [{"name": "site-b", "template": "{date:2006-01-02}_{barcode}"}]}
+func ReadFilenameSchemes(file string) ([]FilenameScheme, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f := filenameSchemesFile{}
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+
+	return f.Schemes, nil
+}
+
+// NewFilenameParser combines the schemes in order, without schemes the
+// DefaultParser is used.
+func NewFilenameParser(schemes []FilenameScheme) (FilenameParser, error) {
+	if len(schemes) == 0 {
+		return DefaultParser{}, nil
+	}
+
+	ps := MultiParser{}
+	for _, s := range schemes {
+		p, err := s.Parser()
+		if err != nil {
+			return nil, fmt.Errorf("Scheme %v: %v", s.Name, err)
+		}
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
@@ -0,0 +1,142 @@
+package cmds
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_ParseFilename(t *testing.T) {
+	_, _, err := ParseFilename("")
+	if err == nil {
+		t.Fatalf("Expect error was nil")
+	}
+
+	_, _, err = ParseFilename("1_1.pdf")
+	if err == nil {
+		t.Fatalf("Expect error was nil")
+	}
+
+	_, _, err = ParseFilename("20140101_1.pdf")
+	if err == nil {
+		t.Fatalf("Expect error was nil")
+	}
+
+	date, id, err := ParseFilename("20140101_0000001.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)
+	if date != d {
+		t.Fatalf("Expect %v was %v", d, date)
+	}
+
+	if id != "0000001" {
+		t.Fatalf("Expect %v was %v", "0000001", id)
+	}
+
+}
+
+func Test_ParseFilename_Reasons(t *testing.T) {
+	tests := map[string]string{
+		"foo.pdf":              ReasonSegments,
+		"2014_01_0000001.pdf":  ReasonSegments,
+		"2014010_0000001.pdf":  ReasonDateLength,
+		"20140101_00001.pdf":   ReasonBarcodeLength,
+		"2014XX01_0000001.pdf": ReasonMonth,
+		"20141301_0000001.pdf": ReasonMonth,
+		"20140231_0000001.pdf": ReasonDay,
+		"20140100_0000001.pdf": ReasonDay,
+		"YYYY0101_0000001.pdf": ReasonDate,
+	}
+
+	for name, reason := range tests {
+		_, _, err := ParseFilename(name)
+		if !errors.Is(err, ErrFilenameFormat) {
+			t.Fatalf("Expect %v was %v", ErrFilenameFormat, err)
+		}
+
+		fErr, ok := err.(*FilenameError)
+		if !ok || fErr.Reason != reason {
+			t.Fatalf("%v: Expect %v was %v", name, reason, err)
+		}
+	}
+}
+
+func Test_NewTemplateParser(t *testing.T) {
+	p, err := NewTemplateParser("SCAN{*}_{date:2006-01-02}_{barcode:10}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date, barcode, err := p.Parse("SCANa1_2014-01-02_0123456789.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := time.Date(2014, 1, 2, 0, 0, 0, 0, time.Local)
+	if !date.Equal(d) {
+		t.Fatalf("Expect %v was %v", d, date)
+	}
+	if barcode != "0123456789" {
+		t.Fatalf("Expect %v was %v", "0123456789", barcode)
+	}
+
+	_, _, err = p.Parse("SCANa1_2014-01-02_012345678.pdf")
+	if fErr, ok := err.(*FilenameError); !ok || fErr.Reason != ReasonNoMatch {
+		t.Fatalf("Expect %v was %v", ReasonNoMatch, err)
+	}
+
+	_, _, err = p.Parse("SCANa1_2014-13-02_0123456789.pdf")
+	if fErr, ok := err.(*FilenameError); !ok || fErr.Reason != ReasonDate {
+		t.Fatalf("Expect %v was %v", ReasonDate, err)
+	}
+}
+
+func Test_NewRegexpParser(t *testing.T) {
+	_, err := NewRegexpParser(`^(?P<date>\d{8})$`, "")
+	if err == nil {
+		t.Fatalf("Expect error was nil")
+	}
+
+	p, err := NewRegexpParser(`^(?P<barcode>\d+)-(?P<date>\d{6})$`, "020106")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	date, barcode, err := p.Parse("42-020114.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := time.Date(2014, 1, 2, 0, 0, 0, 0, time.Local)
+	if !date.Equal(d) || barcode != "42" {
+		t.Fatalf("Expect (%v, %v) was (%v, %v)", d, "42", date, barcode)
+	}
+}
+
+func Test_MultiParser(t *testing.T) {
+	tpl, err := NewTemplateParser("{date:2006-01-02}_{barcode}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := MultiParser{DefaultParser{}, tpl}
+
+	for _, n := range []string{"20140102_0000001.pdf", "2014-01-02_0000001.pdf"} {
+		date, barcode, err := p.Parse(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := time.Date(2014, 1, 2, 0, 0, 0, 0, time.Local)
+		if !date.Equal(d) || barcode != "0000001" {
+			t.Fatalf("Expect (%v, %v) was (%v, %v)", d, "0000001", date, barcode)
+		}
+	}
+
+	_, _, err = p.Parse("foo.pdf")
+	if fErr, ok := err.(*FilenameError); !ok || fErr.Reason != ReasonNoMatch {
+		t.Fatalf("Expect %v was %v", ReasonNoMatch, err)
+	}
+}
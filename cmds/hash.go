@@ -0,0 +1,314 @@
+package cmds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/docs"
+)
+
+// What the import does with files whose content already exists
+const (
+	// DuplicateReport imports the file and reports it
+	DuplicateReport DuplicatePolicy = iota
+	// DuplicateSkip leaves the file out of the import
+	DuplicateSkip
+)
+
+// Number of hashes looked up per query
+const hashLookupSize = 1000
+
+type (
+	DuplicatePolicy int
+
+	// DuplicateFile is a file with the same content as other docs.
+	DuplicateFile struct {
+		Name     string   `json:"name"`
+		Hash     string   `json:"sha256"`
+		Existing []string `json:"existing"`
+		Action   string   `json:"action"`
+	}
+
+	// DuplicateCluster are docs with identical content.
+	DuplicateCluster struct {
+		Hash string     `json:"sha256"`
+		Docs []docs.Doc `json:"docs"`
+	}
+
+	DuplicatesReport struct {
+		Clusters []DuplicateCluster `json:"clusters"`
+	}
+
+	duplicateRow struct {
+		Hash string `db:"sha256"`
+		ID   int64  `db:"id"`
+		Name string `db:"name"`
+	}
+)
+
+func hashFile(p string) (string, error) {
+	fh, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, fh)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDocFiles computes the SHA-256 of every file.
+func hashDocFiles(files []docFile) error {
+	for i := range files {
+		hash, err := hashFile(files[i].Path)
+		if err != nil {
+			return err
+		}
+		files[i].Hash = hash
+	}
+
+	return nil
+}
+
+// checkDuplicates looks for files whose content is already stored
+// under another doc name or appears twice in files. It returns the files
+// to import according to policy and the found duplicates. Without a
+// hashes table, e.g. in a dry run against a new database, no content is
+// stored yet.
+func checkDuplicates(db *gorp.DbMap, files []docFile, policy DuplicatePolicy) ([]docFile, []DuplicateFile, error) {
+	stored, err := ctrlTableExists(db, DocHashesTable)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	action := map[DuplicatePolicy]string{
+		DuplicateReport: "imported",
+		DuplicateSkip:   "skipped",
+	}[policy]
+
+	names := map[string][]string{}
+	if stored {
+		names, err = readHashNames(db, files)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r := []docFile{}
+	dups := []DuplicateFile{}
+	inImport := map[string]string{}
+	for _, f := range files {
+		existing := []string{}
+		for _, name := range names[f.Hash] {
+			if name != f.Doc.Name {
+				existing = append(existing, name)
+			}
+		}
+
+		if other, ok := inImport[f.Hash]; ok && other != f.Doc.Name {
+			existing = append(existing, other)
+		}
+
+		if len(existing) > 0 {
+			dups = append(dups, DuplicateFile{
+				Name:     f.Doc.Name,
+				Hash:     f.Hash,
+				Existing: existing,
+				Action:   action,
+			})
+
+			if policy == DuplicateSkip {
+				continue
+			}
+		}
+
+		if _, ok := inImport[f.Hash]; !ok {
+			inImport[f.Hash] = f.Doc.Name
+		}
+		r = append(r, f)
+	}
+
+	return r, dups, nil
+}
+
+// readHashNames returns the names of the stored docs by hash for all
+// hashes of files, sorted by name.
+func readHashNames(db gorp.SqlExecutor, files []docFile) (map[string][]string, error) {
+	hashes := []interface{}{}
+	seen := map[string]bool{}
+	for _, f := range files {
+		if !seen[f.Hash] {
+			seen[f.Hash] = true
+			hashes = append(hashes, f.Hash)
+		}
+	}
+
+	r := map[string][]string{}
+	for start := 0; start < len(hashes); start += hashLookupSize {
+		end := start + hashLookupSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		rows := []duplicateRow{}
+		q := fmt.Sprintf(`
+			SELECT h.sha256, d.id, d.name FROM %v AS h, %v AS d
+			WHERE h.doc_id=d.id AND h.sha256 IN (%v)
+			ORDER BY h.sha256, d.name`,
+			DocHashesTable, docs.DocsTable, placeholders(end-start))
+		_, err := db.Select(&rows, q, hashes[start:end]...)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			r[row.Hash] = append(r[row.Hash], row.Name)
+		}
+	}
+
+	return r, nil
+}
+
+func saveDocHash(db gorp.SqlExecutor, docID int64, hash string) error {
+	q := fmt.Sprintf(`
+		INSERT INTO %v (doc_id, sha256) VALUES (?,?)
+		ON DUPLICATE KEY UPDATE sha256=?`,
+		DocHashesTable)
+
+	_, err := db.Exec(q, docID, hash, hash)
+	return err
+}
+
+// FindDuplicateDocs lists all docs with identical content. When dir is
+// not empty the files in dir are hashed first for all docs which have
+// no hash yet, e.g. docs imported before hashes were stored.
+func FindDuplicateDocs(dir string, opts ImportDocsOpts) (Result, error) {
+	result := NewResult()
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
+	docs.AddTables(db)
+
+	err = CreateCtrlTables(db)
+	if err != nil {
+		return result, err
+	}
+
+	if dir != "" {
+		n, err := hashExistingDocs(db, dir, opts)
+		result.Add("hashed", n)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	rows := []duplicateRow{}
+	q := fmt.Sprintf(`
+		SELECT h.sha256, d.id, d.name FROM %v AS h, %v AS d
+		WHERE h.doc_id=d.id AND h.sha256 IN (
+			SELECT sha256 FROM %v GROUP BY sha256 HAVING COUNT(*) > 1
+		)
+		ORDER BY h.sha256, d.name`,
+		DocHashesTable, docs.DocsTable, DocHashesTable)
+	_, err = db.Select(&rows, q)
+	if err != nil {
+		return result, err
+	}
+
+	report := DuplicatesReport{Clusters: []DuplicateCluster{}}
+	for _, row := range rows {
+		n := len(report.Clusters)
+		if n == 0 || report.Clusters[n-1].Hash != row.Hash {
+			report.Clusters = append(report.Clusters, DuplicateCluster{Hash: row.Hash})
+			n++
+		}
+		c := &report.Clusters[n-1]
+		c.Docs = append(c.Docs, docs.Doc{ID: row.ID, Name: row.Name})
+		result.Add("docs", 1)
+	}
+	result.Add("clusters", len(report.Clusters))
+	result.Details = report
+
+	return result, nil
+}
+
+// hashExistingDocs stores the hash of every file in dir which belongs
+// to a doc without hash.
+func hashExistingDocs(db *gorp.DbMap, dir string, opts ImportDocsOpts) (int, error) {
+	opts, err := opts.prepare()
+	if err != nil {
+		return 0, err
+	}
+
+	files, err := readDocFiles(dir, opts)
+	if err != nil {
+		return 0, NewError(KindConfig, err)
+	}
+
+	q := fmt.Sprintf(`
+		SELECT d.id FROM %v AS d LEFT JOIN %v AS h ON h.doc_id=d.id
+		WHERE d.name=? AND h.doc_id IS NULL`,
+		docs.DocsTable, DocHashesTable)
+
+	n := 0
+	for _, f := range files {
+		id, err := db.SelectInt(q, f.Doc.Name)
+		if err == sql.ErrNoRows || (err == nil && id == 0) {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+
+		hash, err := hashFile(f.Path)
+		if err != nil {
+			return n, err
+		}
+
+		err = saveDocHash(db, id, hash)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+func ParseDuplicatePolicy(s string) (DuplicatePolicy, error) {
+	switch s {
+	case "report":
+		return DuplicateReport, nil
+	case "skip":
+		return DuplicateSkip, nil
+	}
+
+	return DuplicateReport, fmt.Errorf("Unknown duplicate policy %v", s)
+}
+
+func (r DuplicatesReport) String() string {
+	buf := &bytes.Buffer{}
+	for _, c := range r.Clusters {
+		names := []string{}
+		for _, d := range c.Docs {
+			names = append(names, fmt.Sprintf("%v (id %v)", d.Name, d.ID))
+		}
+		fmt.Fprintf(buf, "%v\n  %v\n", c.Hash, strings.Join(names, "\n  "))
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,94 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/tochti/docMa-handler/labels"
+)
+
+func Test_HashFile(t *testing.T) {
+	fh, err := ioutil.TempFile(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+
+	_, err = fh.WriteString("docma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+
+	h, err := hashFile(fh.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "b11c94c8519e27ef72aaed5a61022dfba551c872685f02055663cd51db9a36ce"
+	if h != expect {
+		t.Fatalf("Expect %v was %v", expect, h)
+	}
+}
+
+func Test_ImportDocs_Duplicates(t *testing.T) {
+	db := initMySQL(t)
+	err := db.Insert(&labels.Label{
+		ID:   1,
+		Name: "Neu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	err = ioutil.WriteFile(path.Join(td, "20140101_0000001.pdf"), []byte("scan"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ImportDocs(td, ImportDocsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(td, "20140102_0000002.pdf"), []byte("scan"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ImportDocs(td, ImportDocsOpts{OnDuplicate: DuplicateSkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := r.Details.(*DocsReport)
+	if len(report.Duplicates) != 1 ||
+		report.Duplicates[0].Name != "20140102_0000002.pdf" ||
+		report.Duplicates[0].Existing[0] != "20140101_0000001.pdf" {
+		t.Fatalf("Expect %v was %v", "20140102_0000002.pdf", report.Duplicates)
+	}
+
+	n, err := db.SelectInt("SELECT COUNT(*) FROM docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expect %v was %v", 1, n)
+	}
+
+	r, err = FindDuplicateDocs("", ImportDocsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Counts["clusters"] != 0 {
+		t.Fatalf("Expect %v was %v", 0, r.Counts["clusters"])
+	}
+}
@@ -0,0 +1,147 @@
+package cmds
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/docs"
+)
+
+type (
+	// DocsPlan describes what ImportDocs would write to the database.
+	DocsPlan struct {
+		New        []docs.Doc      `json:"new"`
+		Changed    []DocChange     `json:"changed"`
+		Unchanged  []string        `json:"unchanged"`
+		Invalid    []InvalidFile   `json:"invalid"`
+		Duplicates []DuplicateFile `json:"duplicates"`
+		NewLabels  []string        `json:"new_labels"`
+	}
+
+	// DocChange is an existing doc which would be updated by the import.
+	DocChange struct {
+		Name   string   `json:"name"`
+		Fields []string `json:"fields"`
+		Old    docs.Doc `json:"old"`
+		New    docs.Doc `json:"new"`
+	}
+
+	// InvalidFile is a file whose name could not be parsed. Action
+	// tells what the import did with it.
+	InvalidFile struct {
+		Name   string `json:"name"`
+		Error  string `json:"error"`
+		Action string `json:"action"`
+	}
+)
+
+// PlanImportDocs compares the files with the docs in the database
+// without changing anything. Invalid, Duplicates and NewLabels are left
+// to the caller.
+func PlanImportDocs(db *gorp.DbMap, files []docFile) (DocsPlan, error) {
+	plan := DocsPlan{
+		New:        []docs.Doc{},
+		Changed:    []DocChange{},
+		Unchanged:  []string{},
+		Invalid:    []InvalidFile{},
+		Duplicates: []DuplicateFile{},
+		NewLabels:  []string{},
+	}
+
+	q := fmt.Sprintf("SELECT * FROM %v WHERE name=?", docs.DocsTable)
+	for _, f := range files {
+		old := docs.Doc{}
+		err := db.SelectOne(&old, q, f.Doc.Name)
+		if err == sql.ErrNoRows {
+			plan.New = append(plan.New, f.Doc)
+			continue
+		}
+		if err != nil {
+			return plan, err
+		}
+
+		fields := changedDocFields(old, f.Doc)
+		if len(fields) == 0 {
+			plan.Unchanged = append(plan.Unchanged, f.Doc.Name)
+			continue
+		}
+
+		d := f.Doc
+		d.ID = old.ID
+		plan.Changed = append(plan.Changed, DocChange{
+			Name:   f.Doc.Name,
+			Fields: fields,
+			Old:    old,
+			New:    d,
+		})
+	}
+
+	return plan, nil
+}
+
+// changedDocFields returns the columns InsertOrUpdateDoc would change.
+func changedDocFields(old, doc docs.Doc) []string {
+	fields := []string{}
+	if old.Barcode != doc.Barcode {
+		fields = append(fields, "barcode")
+	}
+	if !old.DateOfScan.Equal(doc.DateOfScan) {
+		fields = append(fields, "date_of_scan")
+	}
+	if !old.DateOfReceipt.Equal(doc.DateOfReceipt) {
+		fields = append(fields, "date_of_receipt")
+	}
+	if old.Note != doc.Note {
+		fields = append(fields, "note")
+	}
+
+	return fields
+}
+
+func (p DocsPlan) String() string {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "New docs (%v):\n", len(p.New))
+	for _, d := range p.New {
+		fmt.Fprintf(buf, "  + %v barcode=%v date=%v\n",
+			d.Name, d.Barcode, d.DateOfScan.Format("2006-01-02"))
+	}
+
+	if len(p.NewLabels) > 0 {
+		fmt.Fprintf(buf, "Missing labels: %v\n", strings.Join(p.NewLabels, ", "))
+	}
+
+	fmt.Fprintf(buf, "Changed docs (%v):\n", len(p.Changed))
+	for _, c := range p.Changed {
+		fmt.Fprintf(buf, "  ~ %v (%v)\n", c.Name, strings.Join(c.Fields, ", "))
+		for _, f := range c.Fields {
+			switch f {
+			case "barcode":
+				fmt.Fprintf(buf, "      barcode: %v -> %v\n", c.Old.Barcode, c.New.Barcode)
+			case "date_of_scan":
+				fmt.Fprintf(buf, "      date_of_scan: %v -> %v\n",
+					c.Old.DateOfScan.Format("2006-01-02"), c.New.DateOfScan.Format("2006-01-02"))
+			case "date_of_receipt":
+				fmt.Fprintf(buf, "      date_of_receipt: %v -> %v\n",
+					c.Old.DateOfReceipt.Format("2006-01-02"), c.New.DateOfReceipt.Format("2006-01-02"))
+			case "note":
+				fmt.Fprintf(buf, "      note: %q -> %q\n", c.Old.Note, c.New.Note)
+			}
+		}
+	}
+
+	fmt.Fprintf(buf, "Unchanged docs: %v\n", len(p.Unchanged))
+
+	fmt.Fprintf(buf, "Invalid filenames (%v):\n", len(p.Invalid))
+	for _, f := range p.Invalid {
+		fmt.Fprintf(buf, "  ! %v: %v (%v)\n", f.Name, f.Error, f.Action)
+	}
+
+	writeDuplicates(buf, p.Duplicates)
+
+	return buf.String()
+}
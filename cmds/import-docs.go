@@ -2,202 +2,590 @@ package cmds
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"os"
 	"path"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"time"
 
 	"gopkg.in/gorp.v1"
 
-	"github.com/tochti/docMa-handler/common"
 	"github.com/tochti/docMa-handler/docs"
 	"github.com/tochti/docMa-handler/labels"
 )
 
-var (
-	ErrFilenameFormat = errors.New("Wrong filename format")
+// What ImportDocs does with files whose name cannot be parsed
+const (
+	// InvalidWarn imports the file with empty barcode and zero date
+	InvalidWarn InvalidNamePolicy = iota
+	// InvalidSkip leaves the file out of the import
+	InvalidSkip
+	// InvalidAbort stops the import before anything is written
+	InvalidAbort
 )
 
-func ImportDocs(dir string) error {
-	db := common.InitMySQL()
+// How the doc name is built for files in subdirectories
+const (
+	// NameBase uses the filename only
+	NameBase DocNamePolicy = iota
+	// NameRelative uses the slash separated path relative to the
+	// import directory, e.g. 2014/01/20140101_0000001.pdf
+	NameRelative
+)
+
+type (
+	InvalidNamePolicy int
+	DocNamePolicy     int
+
+	ImportDocsOpts struct {
+		// DryRun only compares the directory with the database and
+		// reports the plan in Result.Details, nothing is written.
+		DryRun bool
+		// OnInvalidName decides what happens with unparseable filenames
+		OnInvalidName InvalidNamePolicy
+		// Parser reads date and barcode from the filenames, when nil
+		// the DefaultParser is used.
+		Parser FilenameParser
+		// Recursive imports the files of all subdirectories
+		Recursive bool
+		// Include lists glob patterns of files to import, all files
+		// if empty. Patterns with a slash match the relative path,
+		// others the filename.
+		Include []string
+		// Exclude lists glob patterns of files and directories to skip
+		Exclude []string
+		// Hidden also imports files and directories starting with a dot
+		Hidden bool
+		// Name decides how the doc name is built
+		Name DocNamePolicy
+		// OnDuplicate decides what happens with files whose content
+		// is already stored under another doc name
+		OnDuplicate DuplicatePolicy
+		// Labels are joined with every doc, DefaultImportLabels if empty
+		Labels []string
+		// DirLabels also joins the names of the subdirectories of a file
+		DirLabels bool
+		// LabelRules add labels to matching files
+		LabelRules []LabelRule
+		// CreateLabels creates missing labels instead of failing
+		CreateLabels bool
+		// ChunkSize is the number of docs written in one transaction,
+		// 0 writes all docs in a single transaction
+		ChunkSize int
+	}
+
+	// DocsReport lists the files ImportDocs could not import cleanly.
+	DocsReport struct {
+		Invalid    []InvalidFile   `json:"invalid"`
+		Duplicates []DuplicateFile `json:"duplicates"`
+		Chunks     []DocsChunk     `json:"chunks"`
+		// NewLabels are created in the transaction of the first chunk,
+		// they are only listed if it is committed.
+		NewLabels []string `json:"new_labels"`
+	}
+
+	// DocsChunk are docs written in one transaction.
+	DocsChunk struct {
+		Chunk     int    `json:"chunk"`
+		First     string `json:"first"`
+		Last      string `json:"last"`
+		Docs      int    `json:"docs"`
+		Committed bool   `json:"committed"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	// docFile is a file found in the import directory together with
+	// the doc parsed from its filename and the SHA-256 of its content.
+	docFile struct {
+		Path   string
+		Doc    docs.Doc
+		Hash   string
+		Labels []string
+		Err    error
+	}
+)
+
+func ImportDocs(dir string, opts ImportDocsOpts) (Result, error) {
+	result := NewResult()
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
 
 	docs.AddTables(db)
 	labels.AddTables(db)
 
-	l, err := ioutil.ReadDir(dir)
+	opts, err = opts.prepare()
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	newLabel := labels.Label{}
-	err = db.SelectOne(
-		&newLabel,
-		fmt.Sprintf("SELECT * FROM %v WHERE name='Neu'", labels.LabelsTable),
-	)
+	files, err := readDocFiles(dir, opts)
 	if err != nil {
-		return err
+		return result, NewError(KindConfig, err)
+	}
+
+	files, invalid := applyInvalidNamePolicy(files, opts.OnInvalidName)
+	result.Add("invalid", len(invalid))
+	for _, f := range invalid {
+		log.Println(f.Name, f.Error)
 	}
 
-	newDocs := []interface{}{}
-	for _, doc := range l {
-		filename := path.Base(doc.Name())
-		date, barcode, err := ParseFilename(filename)
+	var abortErr error
+	if opts.OnInvalidName == InvalidAbort && len(invalid) > 0 {
+		abortErr = NewError(KindParse, fmt.Errorf("%v invalid filename(s), import aborted", len(invalid)))
+	}
+
+	err = hashDocFiles(files)
+	if err != nil {
+		return result, err
+	}
+
+	files, dups, err := checkDuplicates(db, files, opts.OnDuplicate)
+	if err != nil {
+		return result, err
+	}
+	result.Add("duplicates", len(dups))
+
+	if opts.DryRun {
+		plan, err := PlanImportDocs(db, files)
 		if err != nil {
-			log.Println(err)
-		}
-		d := docs.Doc{
-			Name:          filename,
-			Barcode:       barcode,
-			DateOfScan:    date,
-			DateOfReceipt: date,
+			return result, err
 		}
-		id, err := InsertOrUpdateDoc(db, d)
+
+		_, missing, err := readLabelIDs(db, fileLabels(files))
 		if err != nil {
-			return err
+			return result, err
 		}
-		d.ID = id
+		if len(missing) > 0 && !opts.CreateLabels {
+			result.AddError("Missing label(s) %v", strings.Join(missing, ", "))
+		}
+		plan.NewLabels = missing
+
+		plan.Invalid = invalid
+		plan.Duplicates = dups
+		result.Add("new", len(plan.New))
+		result.Add("changed", len(plan.Changed))
+		result.Add("unchanged", len(plan.Unchanged))
+		result.Details = plan
 
-		newDocs = append(newDocs, &d)
+		return result, abortErr
 	}
 
-	dFn := func(i interface{}) string {
-		d, _ := i.(*docs.Doc)
-		return fmt.Sprintf("(%v,%v)", d.ID, newLabel.ID)
+	report := DocsReport{
+		Invalid:    invalid,
+		Duplicates: dups,
+		Chunks:     []DocsChunk{},
+		NewLabels:  []string{},
 	}
-	err = BatchInsertOrIgnore(db, "(doc_id,label_id)", newDocs, docs.DocsLabelsTable, dFn)
+	result.Details = &report
+	if abortErr != nil {
+		return result, abortErr
+	}
+
+	err = CreateCtrlTables(db)
 	if err != nil {
-		return err
+		return result, err
+	}
+
+	labelIDs, missing, err := checkLabels(db, fileLabels(files), opts.CreateLabels)
+	if err != nil {
+		return result, err
 	}
 
-	zeroDate := time.Time{}
-	dFn = func(i interface{}) string {
-		d, _ := i.(*docs.Doc)
-		return fmt.Sprintf("(%v,%v,'%v','%v')", d.ID, 0, zeroDate, zeroDate)
+	report.Chunks, err = writeDocChunks(db, files, labelIDs, missing, opts.ChunkSize)
+	for _, c := range report.Chunks {
+		if c.Committed {
+			result.Add("docs", c.Docs)
+		}
+	}
+	if len(report.Chunks) > 0 && report.Chunks[0].Committed {
+		report.NewLabels = missing
+		result.Add("labels", len(missing))
 	}
-	err = BatchInsertOrIgnore(
-		db,
-		"(doc_id,account_number,period_from,period_to)",
-		newDocs,
-		docs.DocAccountDataTable,
-		dFn,
-	)
 	if err != nil {
-		return err
+		return result, partialErr(result.Counts["docs"], err)
 	}
 
-	return nil
+	return result, nil
 }
 
-func ParseFilename(n string) (time.Time, string, error) {
-	ext := path.Ext(n)
-	if len(ext) > 0 {
-		n = strings.Replace(n, ext, "", -1)
+// writeDocChunks writes files in chunks of size docs, each chunk in its
+// own transaction. The labels of newLabels are created in the first
+// chunk. It stops at the first failing chunk, which is rolled back.
+func writeDocChunks(db *gorp.DbMap, files []docFile, labelIDs map[string]int64, newLabels []string, size int) ([]DocsChunk, error) {
+	if size <= 0 {
+		size = len(files)
 	}
-	r := strings.Split(n, "_")
-	zeroDate := time.Time{}
 
-	if len(r) != 2 {
-		return zeroDate, "", ErrFilenameFormat
+	chunks := []DocsChunk{}
+	for i := 0; i < len(files); i += size {
+		end := i + size
+		if end > len(files) {
+			end = len(files)
+		}
+		part := files[i:end]
+
+		c := DocsChunk{
+			Chunk: len(chunks) + 1,
+			First: part[0].Doc.Name,
+			Last:  part[len(part)-1].Doc.Name,
+			Docs:  len(part),
+		}
+
+		err := writeDocsTx(db, part, labelIDs, newLabels)
+		newLabels = nil
+		if err != nil {
+			c.Error = err.Error()
+			chunks = append(chunks, c)
+			msg := fmt.Errorf("Chunk %v (%v - %v) rolled back, %v chunk(s) committed: %v",
+				c.Chunk, c.First, c.Last, len(chunks)-1, err)
+			return chunks, msg
+		}
+
+		c.Committed = true
+		chunks = append(chunks, c)
 	}
-	if len(r[0]) != 8 {
-		return zeroDate, "", ErrFilenameFormat
+
+	return chunks, nil
+}
+
+// writeDocsTx creates newLabels and calls writeDocs in a transaction.
+// The ids of the new labels are added to labelIDs after the commit.
+func writeDocsTx(db *gorp.DbMap, files []docFile, labelIDs map[string]int64, newLabels []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
-	if len(r[1]) != 7 {
-		return zeroDate, "", ErrFilenameFormat
+
+	ids := map[string]int64{}
+	for l, id := range labelIDs {
+		ids[l] = id
 	}
 
-	year, err := strconv.ParseInt(r[0][0:4], 10, 32)
-	if err != nil {
-		return zeroDate, "", ErrFilenameFormat
+	err = createLabels(tx, newLabels, ids)
+	if err == nil {
+		_, err = writeDocs(db, tx, files, ids)
 	}
-	month, err := strconv.ParseInt(r[0][4:6], 10, 32)
 	if err != nil {
-		return zeroDate, "", ErrFilenameFormat
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
+		}
+		return err
 	}
-	day, err := strconv.ParseInt(r[0][6:8], 10, 32)
+
+	err = tx.Commit()
 	if err != nil {
-		return zeroDate, "", ErrFilenameFormat
+		return err
 	}
-	date := time.Date(int(year), time.Month(int(month)), int(day), 0, 0, 0, 0, time.Local)
 
-	id := r[1]
+	for _, l := range newLabels {
+		labelIDs[l] = ids[l]
+	}
 
-	return date, id, nil
+	return nil
 }
 
-func InsertOrUpdateDoc(db *gorp.DbMap, doc docs.Doc) (int64, error) {
-	q := fmt.Sprintf(`
-		INSERT INTO %v 
-		(name, barcode, date_of_scan, date_of_receipt, note)
-		VALUES (?,?,?,?,?)
-		ON DUPLICATE KEY UPDATE id=LAST_INSERT_ID(id), barcode=?, date_of_scan=?, date_of_receipt=?, note=?`,
-		docs.DocsTable)
+// prepare sets the defaults of opts and checks the glob patterns.
+func (opts ImportDocsOpts) prepare() (ImportDocsOpts, error) {
+	if opts.Parser == nil {
+		opts.Parser = DefaultParser{}
+	}
 
-	result, err := db.Exec(q,
-		doc.Name, doc.Barcode, doc.DateOfScan, doc.DateOfReceipt, doc.Note,
-		doc.Barcode, doc.DateOfScan, doc.DateOfReceipt, doc.Note)
+	for _, pattern := range append(opts.Include, opts.Exclude...) {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return opts, NewError(KindConfig, fmt.Errorf("Pattern %v: %v", pattern, err))
+		}
+	}
+
+	return opts, nil
+}
+
+// writeDocs inserts or updates the docs of files, joins them with their
+// labels and creates empty account data. labelIDs has to contain all
+// labels of files. The statements are executed with db, dbMap provides
+// the table mappings. It returns the number of docs written.
+func writeDocs(dbMap *gorp.DbMap, db gorp.SqlExecutor, files []docFile, labelIDs map[string]int64) (int, error) {
+	docsLabels := []docs.DocsLabels{}
+	accountData := []docs.DocAccountData{}
+	for _, f := range files {
+		d := f.Doc
+		id, err := InsertOrUpdateDoc(db, d)
+		if err != nil {
+			return len(accountData), err
+		}
+		d.ID = id
+
+		if f.Hash != "" {
+			err := saveDocHash(db, id, f.Hash)
+			if err != nil {
+				return len(accountData), err
+			}
+		}
+
+		accountData = append(accountData, docs.DocAccountData{DocID: id})
+		for _, l := range f.Labels {
+			docsLabels = append(docsLabels, docs.DocsLabels{
+				DocID:   id,
+				LabelID: labelIDs[l],
+			})
+		}
+	}
+
+	w := NewBulkWriter(dbMap, db, BulkInsertIgnore)
+	err := w.Write(docsLabels)
 	if err != nil {
-		return -1, err
+		return len(accountData), err
 	}
 
-	id, err := result.LastInsertId()
+	err = w.Write(accountData)
 	if err != nil {
-		return -1, err
+		return len(accountData), err
 	}
 
-	return id, nil
+	return len(accountData), nil
 }
 
-func BatchInsertOrIgnore(sqlDB *gorp.DbMap, fields string, data []interface{}, table string, valueSta func(interface{}) string) error {
-	if len(data) == 0 {
+// applyInvalidNamePolicy returns the files which should be imported and
+// a report entry for every file with an invalid name.
+func applyInvalidNamePolicy(files []docFile, policy InvalidNamePolicy) ([]docFile, []InvalidFile) {
+	action := map[InvalidNamePolicy]string{
+		InvalidWarn:  "imported",
+		InvalidSkip:  "skipped",
+		InvalidAbort: "aborted",
+	}[policy]
+
+	r := []docFile{}
+	invalid := []InvalidFile{}
+	for _, f := range files {
+		if f.Err == nil {
+			r = append(r, f)
+			continue
+		}
+
+		reason := f.Err.Error()
+		if fErr, ok := f.Err.(*FilenameError); ok {
+			reason = fErr.Reason
+		}
+		invalid = append(invalid, InvalidFile{
+			Name:   f.Doc.Name,
+			Error:  reason,
+			Action: action,
+		})
+
+		if policy == InvalidWarn {
+			r = append(r, f)
+		}
+	}
+
+	return r, invalid
+}
+
+// readDocFiles lists dir and parses the filename of every file which
+// passes the filters of opts.
+func readDocFiles(dir string, opts ImportDocsOpts) ([]docFile, error) {
+	files := []docFile{}
+	names := map[string]string{}
+
+	err := walkDocFiles(dir, opts, func(rel string, fi os.FileInfo) error {
+		f := opts.newDocFile(dir, rel)
+		if other, ok := names[f.Doc.Name]; ok {
+			return fmt.Errorf("%v and %v have the same doc name %v", other, rel, f.Doc.Name)
+		}
+		names[f.Doc.Name] = rel
+		files = append(files, f)
+
 		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	q := fmt.Sprintf("INSERT IGNORE INTO %v %v VALUES", table, fields)
-	iData := bytes.NewBufferString(valueSta(data[0]))
-	size := len(q) + iData.Len()
-	count := 1
-	for x := 1; x < len(data); x++ {
-		d := fmt.Sprintf(",%v", valueSta(data[x]))
-		size += len(d)
+	return files, nil
+}
 
-		// When the insert query is bigger then 1Mbyte write it to db
-		if size > 1000000 {
-			e := fmt.Sprintf("%v %v", q, iData.String())
-			log.Println(e)
-			_, err := sqlDB.Exec(e)
-			if err != nil {
-				return err
+// walkDocFiles calls fn with the slash separated relative path of every
+// regular file in dir which passes the filters of opts.
+func walkDocFiles(dir string, opts ImportDocsOpts, fn func(rel string, fi os.FileInfo) error) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			if !opts.Recursive || !opts.acceptDir(rel, fi.Name()) {
+				return filepath.SkipDir
 			}
+			return nil
+		}
 
-			iData = bytes.NewBufferString(valueSta(data[x]))
-			size = len(q)
-			count++
-			continue
+		if !fi.Mode().IsRegular() || !opts.acceptFile(rel, fi.Name()) {
+			return nil
 		}
 
-		iData.WriteString(d)
-		count++
+		return fn(rel, fi)
+	})
+}
 
+// newDocFile parses the file with the slash separated path rel relative
+// to the import directory dir.
+func (opts ImportDocsOpts) newDocFile(dir, rel string) docFile {
+	filename := path.Base(rel)
+	name := filename
+	if opts.Name == NameRelative {
+		name = rel
 	}
 
-	if iData.Len() > 0 {
-		e := fmt.Sprintf("%v %v", q, iData.String())
-		log.Println(e)
-		_, err := sqlDB.Exec(e)
-		if err != nil {
-			return err
+	date, barcode, err := opts.Parser.Parse(filename)
+
+	return docFile{
+		Labels: opts.docLabels(rel),
+		Path:   filepath.Join(dir, filepath.FromSlash(rel)),
+		Doc: docs.Doc{
+			Name:          name,
+			Barcode:       barcode,
+			DateOfScan:    date,
+			DateOfReceipt: date,
+		},
+		Err: err,
+	}
+}
+
+func (opts ImportDocsOpts) acceptDir(rel, name string) bool {
+	if !opts.Hidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	return !matchAny(opts.Exclude, rel, name)
+}
+
+func (opts ImportDocsOpts) acceptFile(rel, name string) bool {
+	if !opts.Hidden && strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	if matchAny(opts.Exclude, rel, name) {
+		return false
+	}
+
+	return len(opts.Include) == 0 || matchAny(opts.Include, rel, name)
+}
+
+// matchAny reports whether one of the glob patterns matches. Patterns
+// with a slash are matched against the relative path, all others
+// against the name.
+func matchAny(patterns []string, rel, name string) bool {
+	for _, pattern := range patterns {
+		s := name
+		if strings.Contains(pattern, "/") {
+			s = rel
+		}
+
+		// Patterns are checked by ImportDocs
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
 		}
 	}
 
-	if count != len(data) {
-		msg := fmt.Sprintf("Expect %v data was %v - %v", len(data), count, data)
-		return errors.New(msg)
+	return false
+}
+
+func ParseDocNamePolicy(s string) (DocNamePolicy, error) {
+	switch s {
+	case "base":
+		return NameBase, nil
+	case "relative":
+		return NameRelative, nil
 	}
 
-	return nil
+	return NameBase, fmt.Errorf("Unknown doc name policy %v", s)
+}
+
+func ParseInvalidNamePolicy(s string) (InvalidNamePolicy, error) {
+	switch s {
+	case "warn":
+		return InvalidWarn, nil
+	case "skip":
+		return InvalidSkip, nil
+	case "abort":
+		return InvalidAbort, nil
+	}
+
+	return InvalidWarn, fmt.Errorf("Unknown invalid name policy %v", s)
+}
+
+func (r DocsReport) String() string {
+	buf := &bytes.Buffer{}
+	if len(r.Invalid) > 0 {
+		fmt.Fprintf(buf, "Invalid filenames (%v):\n", len(r.Invalid))
+		for _, f := range r.Invalid {
+			fmt.Fprintf(buf, "  ! %v: %v (%v)\n", f.Name, f.Error, f.Action)
+		}
+	}
+
+	writeDuplicates(buf, r.Duplicates)
+
+	if len(r.NewLabels) > 0 {
+		fmt.Fprintf(buf, "New labels: %v\n", strings.Join(r.NewLabels, ", "))
+	}
+
+	if len(r.Chunks) > 1 || (len(r.Chunks) == 1 && !r.Chunks[0].Committed) {
+		fmt.Fprintf(buf, "Chunks (%v):\n", len(r.Chunks))
+		for _, c := range r.Chunks {
+			state := "committed"
+			if !c.Committed {
+				state = "rolled back: " + c.Error
+			}
+			fmt.Fprintf(buf, "  %v: %v - %v, %v docs, %v\n", c.Chunk, c.First, c.Last, c.Docs, state)
+		}
+	}
+
+	return buf.String()
+}
+
+func writeDuplicates(buf *bytes.Buffer, dups []DuplicateFile) {
+	if len(dups) == 0 {
+		return
+	}
+
+	fmt.Fprintf(buf, "Duplicate content (%v):\n", len(dups))
+	for _, d := range dups {
+		fmt.Fprintf(buf, "  = %v same as %v (%v)\n", d.Name, strings.Join(d.Existing, ", "), d.Action)
+	}
+}
+
+func InsertOrUpdateDoc(db gorp.SqlExecutor, doc docs.Doc) (int64, error) {
+	q := fmt.Sprintf(`
+		INSERT INTO %v 
+		(name, barcode, date_of_scan, date_of_receipt, note)
+		VALUES (?,?,?,?,?)
+		ON DUPLICATE KEY UPDATE id=LAST_INSERT_ID(id), barcode=?, date_of_scan=?, date_of_receipt=?, note=?`,
+		docs.DocsTable)
+
+	result, err := db.Exec(q,
+		doc.Name, doc.Barcode, doc.DateOfScan, doc.DateOfReceipt, doc.Note,
+		doc.Barcode, doc.DateOfScan, doc.DateOfReceipt, doc.Note)
+	if err != nil {
+		return -1, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
 }
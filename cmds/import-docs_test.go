@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"reflect"
 	"testing"
 	"time"
 
@@ -33,7 +34,7 @@ func Test_ImportDocs_Default(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = ImportDocs(td)
+	_, err = ImportDocs(td, ImportDocsOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -110,40 +111,336 @@ func Test_ImportDocs_DuplicateEntry(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = ImportDocs(td)
+	_, err = ImportDocs(td, ImportDocsOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func Test_ParseFilename(t *testing.T) {
-	_, _, err := ParseFilename("")
-	if err == nil {
-		t.Fatalf("Expect error was nil")
+func Test_ImportDocs_DryRun(t *testing.T) {
+	db := initMySQL(t)
+	err := db.Insert(&labels.Label{
+		ID:   1,
+		Name: "Neu",
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	_, _, err = ParseFilename("1_1.pdf")
-	if err == nil {
-		t.Fatalf("Expect error was nil")
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for _, n := range []string{"20140101_0000001.pdf", "20140101_0000002.pdf", "foo.pdf"} {
+		_, err = os.Create(path.Join(td, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.Insert(&docs.Doc{
+		Name:    "20140101_0000002.pdf",
+		Barcode: "0000003",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ImportDocs(td, ImportDocsOpts{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, ok := r.Details.(DocsPlan)
+	if !ok {
+		t.Fatalf("Expect %T was %T", DocsPlan{}, r.Details)
+	}
+
+	if len(plan.New) != 2 {
+		t.Fatalf("Expect %v was %v", 2, len(plan.New))
+	}
+
+	if len(plan.Changed) != 1 || plan.Changed[0].Name != "20140101_0000002.pdf" {
+		t.Fatalf("Expect %v was %v", "20140101_0000002.pdf", plan.Changed)
+	}
+
+	if len(plan.Invalid) != 1 || plan.Invalid[0].Name != "foo.pdf" {
+		t.Fatalf("Expect %v was %v", "foo.pdf", plan.Invalid)
+	}
+
+	n, err := db.SelectInt("SELECT COUNT(*) FROM docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expect %v was %v", 1, n)
+	}
+}
+
+func Test_ImportDocs_DryRunWithoutCtrlTables(t *testing.T) {
+	db := initMySQL(t)
+	err := DropCtrlTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for _, n := range []string{"20140101_0000001.pdf", "20140101_0000002.pdf"} {
+		_, err = os.Create(path.Join(td, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := ImportDocs(td, ImportDocsOpts{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both files are empty, so the second is a duplicate within the import
+	if r.Counts["duplicates"] != 1 {
+		t.Fatalf("Expect %v was %v", 1, r.Counts["duplicates"])
+	}
+
+	ok, err := ctrlTableExists(db, DocHashesTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("Expect %v was %v", false, ok)
+	}
+}
+
+func Test_ApplyInvalidNamePolicy(t *testing.T) {
+	files := []docFile{
+		{Doc: docs.Doc{Name: "20140101_0000001.pdf"}},
+		{Doc: docs.Doc{Name: "foo.pdf"}, Err: &FilenameError{"foo.pdf", ReasonSegments}},
+	}
+
+	r, invalid := applyInvalidNamePolicy(files, InvalidWarn)
+	if len(r) != 2 || len(invalid) != 1 {
+		t.Fatalf("Expect (%v, %v) was (%v, %v)", 2, 1, len(r), len(invalid))
+	}
+
+	r, invalid = applyInvalidNamePolicy(files, InvalidSkip)
+	if len(r) != 1 || r[0].Doc.Name != "20140101_0000001.pdf" {
+		t.Fatalf("Expect %v was %v", files[:1], r)
+	}
+
+	expect := InvalidFile{Name: "foo.pdf", Error: ReasonSegments, Action: "skipped"}
+	if len(invalid) != 1 || invalid[0] != expect {
+		t.Fatalf("Expect %v was %v", expect, invalid)
+	}
+}
+
+func Test_ReadDocFiles(t *testing.T) {
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for _, n := range []string{
+		"20140101_0000001.pdf",
+		"20140101_0000002.tmp",
+		".20140101_0000003.pdf",
+		"2014/20140101_0000004.pdf",
+		"2014/.hidden/20140101_0000005.pdf",
+		"skip/20140101_0000006.pdf",
+	} {
+		err := os.MkdirAll(path.Join(td, path.Dir(n)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Create(path.Join(td, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := ImportDocsOpts{
+		Parser:  DefaultParser{},
+		Include: []string{"*.pdf"},
+		Exclude: []string{"skip"},
+	}
+	files, err := readDocFiles(td, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Doc.Name != "20140101_0000001.pdf" {
+		t.Fatalf("Expect %v was %v", "20140101_0000001.pdf", files)
+	}
+
+	opts.Recursive = true
+	opts.Name = NameRelative
+	files, err = readDocFiles(td, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"2014/20140101_0000004.pdf", "20140101_0000001.pdf"}
+	if len(files) != len(expect) {
+		t.Fatalf("Expect %v was %v", expect, files)
+	}
+	for i, n := range expect {
+		if files[i].Doc.Name != n || files[i].Err != nil {
+			t.Fatalf("Expect %v was %v", n, files[i])
+		}
+	}
+	if files[0].Doc.Barcode != "0000004" {
+		t.Fatalf("Expect %v was %v", "0000004", files[0].Doc.Barcode)
+	}
+}
+
+func Test_DocLabels(t *testing.T) {
+	opts := ImportDocsOpts{}
+	l := opts.docLabels("2014/20140101_0000001.pdf")
+	if !reflect.DeepEqual(DefaultImportLabels, l) {
+		t.Fatalf("Expect %v was %v", DefaultImportLabels, l)
+	}
+
+	opts = ImportDocsOpts{
+		Labels:    []string{"Neu", "Scan"},
+		DirLabels: true,
+		LabelRules: []LabelRule{
+			{Pattern: "invoices/*", Labels: []string{"Rechnung"}},
+			{Pattern: "*_99*", Labels: []string{"Kasse", "Neu"}},
+		},
+	}
+	l = opts.docLabels("invoices/20140101_9900001.pdf")
+	expect := []string{"Neu", "Scan", "invoices", "Rechnung", "Kasse"}
+	if !reflect.DeepEqual(expect, l) {
+		t.Fatalf("Expect %v was %v", expect, l)
 	}
+}
+
+func Test_ImportDocs_CreateLabels(t *testing.T) {
+	db := initMySQL(t)
+
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	_, err = os.Create(path.Join(td, "20140101_0000001.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ImportDocsOpts{Labels: []string{"Scan", "Neu"}}
+	_, err = ImportDocs(td, opts)
+	if KindOf(err) != KindConfig {
+		t.Fatalf("Expect %v was %v", KindConfig, err)
+	}
+
+	opts.CreateLabels = true
+	_, err = ImportDocs(td, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.SelectInt("SELECT COUNT(*) FROM docs_labels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("Expect %v was %v", 2, n)
+	}
+}
+
+func Test_ImportDocs_CreateLabelsRollback(t *testing.T) {
+	db := initMySQL(t)
 
-	_, _, err = ParseFilename("20140101_1.pdf")
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	_, err = os.Create(path.Join(td, "20140101_0000001.pdf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writing the account data fails after the label is created
+	_, err = db.Exec("DROP TABLE " + docs.DocAccountDataTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ImportDocsOpts{Labels: []string{"Scan"}, CreateLabels: true}
+	r, err := ImportDocs(td, opts)
 	if err == nil {
-		t.Fatalf("Expect error was nil")
+		t.Fatalf("Expect %v was %v", "error", err)
+	}
+
+	report := r.Details.(*DocsReport)
+	if len(report.NewLabels) != 0 {
+		t.Fatalf("Expect %v was %v", 0, report.NewLabels)
 	}
 
-	date, id, err := ParseFilename("20140101_0000001.pdf")
+	n, err := db.SelectInt("SELECT COUNT(*) FROM labels")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if n != 0 {
+		t.Fatalf("Expect %v was %v", 0, n)
+	}
+}
 
-	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.Local)
-	if date != d {
-		t.Fatalf("Expect %v was %v", d, date)
+func Test_ImportDocs_Chunks(t *testing.T) {
+	db := initMySQL(t)
+	err := db.Insert(&labels.Label{
+		ID:   1,
+		Name: "Neu",
+	})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	if id != "0000001" {
-		t.Fatalf("Expect %v was %v", "0000001", id)
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	for _, n := range []string{"20140101_0000001.pdf", "20140101_0000002.pdf", "20140101_0000003.pdf"} {
+		err = ioutil.WriteFile(path.Join(td, n), []byte(n), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
+	r, err := ImportDocs(td, ImportDocsOpts{ChunkSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := r.Details.(*DocsReport)
+	if len(report.Chunks) != 2 {
+		t.Fatalf("Expect %v was %v", 2, len(report.Chunks))
+	}
+
+	expect := DocsChunk{
+		Chunk:     2,
+		First:     "20140101_0000003.pdf",
+		Last:      "20140101_0000003.pdf",
+		Docs:      1,
+		Committed: true,
+	}
+	if report.Chunks[1] != expect {
+		t.Fatalf("Expect %v was %v", expect, report.Chunks[1])
+	}
+
+	if r.Counts["docs"] != 3 {
+		t.Fatalf("Expect %v was %v", 3, r.Counts["docs"])
+	}
 }
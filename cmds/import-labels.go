@@ -0,0 +1,173 @@
+package cmds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/labels"
+)
+
+var (
+	// DefaultImportLabels are joined with every imported doc when no
+	// labels are configured
+	DefaultImportLabels = []string{"Neu"}
+)
+
+type (
+	// LabelRule adds Labels to all files matching the glob Pattern.
+	// Patterns with a slash match the path relative to the import
+	// directory, others the filename.
+	LabelRule struct {
+		Pattern string   `json:"pattern"`
+		Labels  []string `json:"labels"`
+	}
+
+	labelRulesFile struct {
+		Rules []LabelRule `json:"rules"`
+	}
+)
+
+// baseLabels returns the labels joined with every doc.
+func (opts ImportDocsOpts) baseLabels() []string {
+	if len(opts.Labels) == 0 {
+		return DefaultImportLabels
+	}
+
+	return opts.Labels
+}
+
+// docLabels returns the label names for the file with the slash
+// separated relative path rel.
+func (opts ImportDocsOpts) docLabels(rel string) []string {
+	r := append([]string{}, opts.baseLabels()...)
+
+	if opts.DirLabels {
+		dir := path.Dir(rel)
+		if dir != "." {
+			r = append(r, strings.Split(dir, "/")...)
+		}
+	}
+
+	for _, rule := range opts.LabelRules {
+		if matchAny([]string{rule.Pattern}, rel, path.Base(rel)) {
+			r = append(r, rule.Labels...)
+		}
+	}
+
+	RemoveDuplicates(&r)
+
+	return r
+}
+
+// fileLabels returns the sorted label names used by files.
+func fileLabels(files []docFile) []string {
+	r := []string{}
+	for _, f := range files {
+		r = append(r, f.Labels...)
+	}
+	RemoveDuplicates(&r)
+	sort.Strings(r)
+
+	return r
+}
+
+// readLabelIDs returns the ids of the labels, labels which do not exist
+// are returned in missing.
+func readLabelIDs(db gorp.SqlExecutor, names []string) (map[string]int64, []string, error) {
+	ids := map[string]int64{}
+	missing := []string{}
+
+	q := fmt.Sprintf("SELECT * FROM %v WHERE name=?", labels.LabelsTable)
+	for _, n := range names {
+		l := labels.Label{}
+		err := db.SelectOne(&l, q, n)
+		if err == sql.ErrNoRows {
+			missing = append(missing, n)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ids[n] = l.ID
+	}
+
+	return ids, missing, nil
+}
+
+// resolveLabels returns the ids of the labels. Missing labels are
+// created when create is true, otherwise a config error is returned.
+func resolveLabels(db gorp.SqlExecutor, names []string, create bool) (map[string]int64, error) {
+	ids, missing, err := checkLabels(db, names, create)
+	if err != nil {
+		return nil, err
+	}
+
+	err = createLabels(db, missing, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// checkLabels is readLabelIDs but returns a config error for missing
+// labels when create is false. The caller creates the missing labels,
+// e.g. in the transaction of the docs using them.
+func checkLabels(db gorp.SqlExecutor, names []string, create bool) (map[string]int64, []string, error) {
+	ids, missing, err := readLabelIDs(db, names)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(missing) > 0 && !create {
+		msg := fmt.Errorf("Missing label(s) %v", strings.Join(missing, ", "))
+		return nil, nil, NewError(KindConfig, msg)
+	}
+
+	return ids, missing, nil
+}
+
+// createLabels inserts the labels and adds their ids to ids.
+func createLabels(db gorp.SqlExecutor, names []string, ids map[string]int64) error {
+	for _, n := range names {
+		l := labels.Label{Name: n}
+		err := db.Insert(&l)
+		if err != nil {
+			return err
+		}
+		ids[n] = l.ID
+	}
+
+	return nil
+}
+
+// ReadLabelRules reads a JSON file of the form
+// {"rules": [{"pattern": "invoices/*", "labels": ["Rechnung"]}]}
+func ReadLabelRules(file string) ([]LabelRule, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f := labelRulesFile{}
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+
+	for _, r := range f.Rules {
+		_, err := path.Match(r.Pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("%v: pattern %v: %v", file, r.Pattern, err)
+		}
+	}
+
+	return f.Rules, nil
+}
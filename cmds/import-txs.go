@@ -1,42 +1,389 @@
 package cmds
 
 import (
+	"encoding/csv"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/gorp.v1"
 
-	"github.com/tochti/docMa-accountant/accountantService/accountingTxsFileReader"
 	"github.com/tochti/docMa-handler/accountingData"
-	"github.com/tochti/docMa-handler/common"
 )
 
-func ImportAccountingTxs(txsFile string) error {
-	db := common.InitMySQL()
+// What happens with a txs file containing invalid transactions
+const (
+	// TxsAbort imports nothing
+	TxsAbort TxsPolicy = iota
+	// TxsSkipInvalid imports the valid transactions and writes the
+	// invalid ones to the rejects file
+	TxsSkipInvalid
+)
+
+const (
+	// Reading is stopped after this many errors in a row, the reader
+	// is most likely stuck
+	maxTxsReadErrors = 100
+	// Transactions written per statement by default
+	txsBatchSize = 1000
+)
+
+type (
+	TxsPolicy int
+
+	ImportTxsOpts struct {
+		OnInvalid   TxsPolicy
+		OnDuplicate TxsDuplicatePolicy
+		Rules       TxsRules
+		// Format of the txs file, empty detects it
+		Format string
+		// BankAccount and ContraAccount are booked for bank statements
+		BankAccount   int
+		ContraAccount int
+		// RejectsFile defaults to the txs file with .rejects.csv
+		RejectsFile string
+		// BatchSize is the number of transactions per insert statement
+		BatchSize int
+		Progress  io.Writer
+	}
+
+	// txsRow is a transaction and the line it was read from.
+	txsRow struct {
+		Line     int
+		Tx       accountingData.AccountingData
+		Problems []TxsProblem
+		Key      txsKey
+	}
+
+	txsReader interface {
+		Read() (accountingData.AccountingData, error)
+	}
+
+	// liner is implemented by readers which know the line of the last
+	// transaction.
+	liner interface {
+		Line() int
+	}
+)
+
+// ImportAccountingTxs validates all transactions of txsFile before any
+// is written. Depending on opts.OnInvalid problems abort the import or
+// only the valid transactions are imported. Transactions which are
+// already stored are skipped or updated, so an export can be imported
+// again.
+func ImportAccountingTxs(txsFile string, opts ImportTxsOpts) (Result, error) {
+	result := NewResult()
+	valid, err := readValidTxs(txsFile, opts, &result)
+	if err != nil {
+		return result, err
+	}
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
 	accountingData.AddTables(db)
 
-	fh, err := os.Open(txsFile)
+	err = CreateCtrlTables(db)
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+
+	counts, err := importTxs(db, tx, valid, opts)
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
+		}
+		return result, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return result, err
+	}
+
+	for k, n := range counts {
+		result.Add(k, n)
+	}
+
+	return result, nil
+}
+
+// importTxs writes rows with exec, a transaction of dbMap.
+func importTxs(dbMap *gorp.DbMap, exec gorp.SqlExecutor, rows []txsRow, opts ImportTxsOpts) (map[string]int, error) {
+	counts := map[string]int{}
+
+	keys, err := readTxsKeys(exec)
+	if err != nil {
+		return nil, err
+	}
+
+	counts["keyed"], err = backfillTxsKeys(exec, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	insert, update, skipped := planTxs(rows, keys, opts.OnDuplicate)
+	counts["skipped"] = skipped
+
+	p := newProgress(opts.Progress, "txs", len(insert)+len(update))
+	err = insertTxs(dbMap, exec, insert, opts.BatchSize, p)
+	if err != nil {
+		return nil, err
+	}
+	counts["inserted"] = len(insert)
+
+	updated := []txsKey{}
+	for _, r := range update {
+		tx := r.Tx
+		_, err := exec.Update(&tx)
+		if err != nil {
+			return nil, fmt.Errorf("Line %v: %v", r.Line, err)
+		}
+		updated = append(updated, r.Key)
+		p.Add(1)
+	}
+
+	err = saveTxsKeys(exec, updated)
+	if err != nil {
+		return nil, err
+	}
+	counts["updated"] = len(update)
+
+	return counts, nil
+}
+
+// insertTxs writes rows with multi row inserts of batchSize rows and
+// saves their keys. exec has to be a transaction of dbMap.
+func insertTxs(dbMap *gorp.DbMap, exec gorp.SqlExecutor, rows []txsRow, batchSize int, p *progress) error {
+	if batchSize <= 0 {
+		batchSize = txsBatchSize
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	step, err := exec.SelectInt("SELECT @@auto_increment_increment")
+	if err != nil {
+		return err
+	}
+
+	w := NewBulkWriter(dbMap, exec, BulkInsert).SetKeys(true, "ID")
+	w.MaxRows = batchSize
+	for first := 0; first < len(rows); first += batchSize {
+		end := first + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		batch := rows[first:end]
+
+		txs := make([]accountingData.AccountingData, len(batch))
+		for i, r := range batch {
+			txs[i] = r.Tx
+			txs[i].ID = 0
+		}
+
+		stmts, err := w.write(txs)
+		if err == nil {
+			err = keyInsertedTxs(exec, batch, stmts, step)
+		}
+		if err != nil {
+			return fmt.Errorf("Lines %v - %v: %v", batch[0].Line, batch[len(batch)-1].Line, err)
+		}
+
+		p.Add(len(batch))
+	}
+
+	return nil
+}
+
+// keyInsertedTxs saves the keys of rows written by stmts, step is
+// auto_increment_increment.
+func keyInsertedTxs(exec gorp.SqlExecutor, rows []txsRow, stmts []batchStatement, step int64) error {
+	ids, err := insertedIDs(stmts, len(rows), step)
 	if err != nil {
 		return err
 	}
 
-	reader := accountingTxsFileReader.NewReader(fh)
+	keys := make([]txsKey, 0, len(rows))
+	for i, r := range rows {
+		k := r.Key
+		k.ID = ids[i]
+		keys = append(keys, k)
+	}
+
+	return saveTxsKeys(exec, keys)
+}
+
+// readValidTxs reads and validates txsFile. It fails if a transaction
+// is invalid and opts.OnInvalid is TxsAbort, otherwise the invalid
+// transactions are written to the rejects file. The problems are the
+// details of result.
+func readValidTxs(txsFile string, opts ImportTxsOpts, result *Result) ([]txsRow, error) {
+	report := TxsReport{Problems: []TxsProblem{}}
+	result.Details = report
+
+	if opts.Rules.MaxAccount == 0 {
+		opts.Rules = DefaultTxsRules
+	}
+
+	fh, err := os.Open(txsFile)
+	if err != nil {
+		return nil, NewError(KindConfig, err)
+	}
+	defer fh.Close()
+
+	reader, format, err := openTxsReader(fh, opts.Format, opts)
+	if err != nil {
+		return nil, NewError(KindConfig, err)
+	}
+	report.Format = format
+
+	rows, err := readTxsRows(reader, opts.Rules)
+	if err != nil {
+		return nil, NewError(KindParse, err)
+	}
+
+	valid := []txsRow{}
+	invalid := []txsRow{}
+	for _, r := range rows {
+		if len(r.Problems) > 0 {
+			invalid = append(invalid, r)
+			report.Problems = append(report.Problems, r.Problems...)
+			continue
+		}
+		valid = append(valid, r)
+	}
+	result.Add("invalid", len(invalid))
+	result.Details = report
+
+	if len(invalid) > 0 && opts.OnInvalid == TxsAbort {
+		err := fmt.Errorf("%v of %v transactions are invalid, nothing imported", len(invalid), len(rows))
+		return nil, NewError(KindParse, err)
+	}
+
+	if len(invalid) > 0 {
+		if opts.RejectsFile == "" {
+			opts.RejectsFile = txsFile + ".rejects.csv"
+		}
+		err := writeTxsRejects(opts.RejectsFile, invalid)
+		if err != nil {
+			return nil, err
+		}
+		report.Rejected = len(invalid)
+		report.RejectsFile = opts.RejectsFile
+		result.Details = report
+	}
 
-	for {
+	return valid, nil
+}
+
+// readTxsRows reads and validates all transactions. A row the reader
+// fails on is kept as a row with a problem. Lines are taken from the
+// reader if it knows them, otherwise every transaction is one line.
+func readTxsRows(reader txsReader, rules TxsRules) ([]txsRow, error) {
+	rows := []txsRow{}
+	errs := 0
+	for n := 1; ; n++ {
 		tx, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		line := n
+		if l, ok := reader.(liner); ok {
+			line = l.Line()
+		}
+
 		if err != nil {
-			if err == io.EOF {
-				break
+			errs++
+			if errs >= maxTxsReadErrors {
+				return rows, fmt.Errorf("Line %v: %v (%v errors in a row)", line, err, errs)
 			}
 
-			return err
+			rows = append(rows, txsRow{
+				Line:     line,
+				Problems: []TxsProblem{{Line: line, Field: "row", Error: err.Error()}},
+			})
+			continue
 		}
+		errs = 0
 
-		err = db.Insert(&tx)
-		if err != nil {
-			return fmt.Errorf("Line: %v, Error: %v", tx, err)
+		rows = append(rows, txsRow{
+			Line:     line,
+			Tx:       tx,
+			Problems: rules.Validate(line, tx),
+		})
+	}
+
+	return rows, nil
+}
+
+// writeTxsRejects writes the rejected transactions with their problems
+// as semicolon separated CSV.
+func writeTxsRejects(file string, rows []txsRow) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(f)
+	w.Comma = ';'
+	w.Write([]string{
+		"line", "problems",
+		"doc_date", "date_of_entry", "doc_number_range", "doc_number",
+		"posting_text", "amount_posted", "debit_account", "credit_account",
+		"tax_code", "cost_unit1", "cost_unit2", "amount_posted_euro", "currency",
+	})
+	for _, r := range rows {
+		problems := []string{}
+		for _, p := range r.Problems {
+			problems = append(problems, p.Field+": "+p.Error)
 		}
 
+		tx := r.Tx
+		w.Write([]string{
+			fmt.Sprint(r.Line), strings.Join(problems, ", "),
+			txsDate(tx.DocDate), txsDate(tx.DateOfEntry), tx.DocNumberRange, tx.DocNumber,
+			tx.PostingText, fmt.Sprint(tx.AmountPosted), fmt.Sprint(tx.DebitAccount), fmt.Sprint(tx.CreditAccount),
+			fmt.Sprint(tx.TaxCode), tx.CostUnit1, tx.CostUnit2, fmt.Sprint(tx.AmountPostedEuro), tx.Currency,
+		})
 	}
+	w.Flush()
 
-	return nil
+	err = w.Error()
+	cErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return cErr
+}
+
+func txsDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format("2006-01-02")
+}
+
+func ParseTxsPolicy(s string) (TxsPolicy, error) {
+	switch s {
+	case "abort":
+		return TxsAbort, nil
+	case "skip":
+		return TxsSkipInvalid, nil
+	}
+
+	return TxsAbort, fmt.Errorf("Unknown invalid transaction policy %v", s)
 }
@@ -0,0 +1,116 @@
+package cmds
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+func Test_ImportTxs(t *testing.T) {
+	db := initMySQL(t)
+
+	// A migrated transaction without key
+	old := validTx()
+	old.DocNumber = "DN-old"
+	err := db.Insert(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []txsRow{}
+	for i := 0; i < 5; i++ {
+		tx := validTx()
+		tx.DocNumber = fmt.Sprintf("DN%v", i)
+		rows = append(rows, txsRow{Line: i + 1, Tx: tx})
+	}
+
+	opts := ImportTxsOpts{BatchSize: 2}
+	counts, err := importTxsTx(t, db, rows, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["keyed"] != 1 || counts["inserted"] != 5 {
+		t.Fatalf("Expect %v was %v", "1 keyed and 5 inserted", counts)
+	}
+
+	keys := []struct {
+		DocNumber  string `db:"doc_number"`
+		NaturalKey string `db:"natural_key"`
+	}{}
+	q := fmt.Sprintf(`
+		SELECT a.doc_number, k.natural_key FROM %v AS a, %v AS k
+		WHERE k.accounting_data_id=a.id ORDER BY a.id`,
+		accountingData.AccountingDataTable, TxsKeysTable)
+	_, err = db.Select(&keys, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 6 {
+		t.Fatalf("Expect %v was %v", 6, len(keys))
+	}
+	for i, r := range rows {
+		k := keys[i+1]
+		if k.DocNumber != r.Tx.DocNumber || k.NaturalKey != txsNaturalKey(r.Tx) {
+			t.Fatalf("Expect %v was %v", r.Tx.DocNumber, k)
+		}
+	}
+
+	// The last batch fails, nothing of the import is kept
+	failing := validTx()
+	failing.DocNumber = "DN-fail"
+	failing.PostingText = strings.Repeat("x", 70000)
+	more := []txsRow{}
+	for i := 5; i < 8; i++ {
+		tx := validTx()
+		tx.DocNumber = fmt.Sprintf("DN%v", i)
+		more = append(more, txsRow{Line: i + 1, Tx: tx})
+	}
+	more = append(more, txsRow{Line: 9, Tx: failing})
+
+	_, err = importTxsTx(t, db, more, opts)
+	if err == nil || !strings.HasPrefix(err.Error(), "Lines 8 - 9") {
+		t.Fatalf("Expect %v was %v", "error in lines 8 - 9", err)
+	}
+
+	for _, table := range []string{accountingData.AccountingDataTable, TxsKeysTable} {
+		n, err := db.SelectInt("SELECT COUNT(*) FROM " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 6 {
+			t.Fatalf("Expect %v was %v", 6, n)
+		}
+	}
+
+	// An import of the same rows again skips them
+	counts, err = importTxsTx(t, db, rows, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["skipped"] != 5 || counts["inserted"] != 0 {
+		t.Fatalf("Expect %v was %v", "5 skipped", counts)
+	}
+}
+
+// importTxsTx runs importTxs in a transaction like ImportAccountingTxs.
+func importTxsTx(t *testing.T, db *gorp.DbMap, rows []txsRow, opts ImportTxsOpts) (map[string]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := importTxs(db, tx, rows, opts)
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			t.Fatal(rErr)
+		}
+		return counts, err
+	}
+
+	return counts, tx.Commit()
+}
@@ -42,10 +42,20 @@ func initMySQL(t *testing.T) *gorp.DbMap {
 		t.Fatal(err)
 	}
 
+	err = DropCtrlTables(dbMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	err = dbMap.CreateTablesIfNotExists()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	err = CreateCtrlTables(dbMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	return dbMap
 }
@@ -0,0 +1,108 @@
+package cmds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/tochti/docMa-handler/labels"
+)
+
+type (
+	// LabelNormalizer decides which label names are the same label.
+	// Trim removes surrounding white space, NFC composes the unicode
+	// characters and Fold ignores the case when names are compared.
+	// Aliases maps names to the label they should be merged into, it is
+	// set with WithAliases. The zero value leaves all names untouched.
+	LabelNormalizer struct {
+		Trim    bool
+		Fold    bool
+		NFC     bool
+		aliases map[string]string
+	}
+
+	labelAliasesFile struct {
+		Aliases map[string]string `json:"aliases"`
+	}
+)
+
+// WithAliases returns n merging every alias into its label. Aliases
+// are resolved once, an alias pointing to another alias is not followed.
+func (n LabelNormalizer) WithAliases(aliases map[string]string) LabelNormalizer {
+	n.aliases = map[string]string{}
+	for alias, name := range aliases {
+		n.aliases[n.Key(alias)] = n.clean(name)
+	}
+
+	return n
+}
+
+// Name returns the name a label is created with.
+func (n LabelNormalizer) Name(name string) string {
+	name = n.clean(name)
+	if a, ok := n.aliases[n.Key(name)]; ok {
+		return a
+	}
+
+	return name
+}
+
+// Key returns the name used to compare labels.
+func (n LabelNormalizer) Key(name string) string {
+	name = n.clean(name)
+	if n.Fold {
+		name = cases.Fold().String(name)
+	}
+
+	return name
+}
+
+// LabelKey returns the key of the label name will be merged into.
+func (n LabelNormalizer) LabelKey(name string) string {
+	return n.Key(n.Name(name))
+}
+
+func (n LabelNormalizer) clean(name string) string {
+	if n.Trim {
+		name = strings.TrimSpace(name)
+	}
+	if n.NFC {
+		name = norm.NFC.String(name)
+	}
+
+	return name
+}
+
+// labelMap returns the ids of labels keyed by LabelKey.
+func (n LabelNormalizer) labelMap(ll []labels.Label) map[string]int64 {
+	m := map[string]int64{}
+	for _, l := range ll {
+		k := n.LabelKey(l.Name)
+		if _, ok := m[k]; !ok {
+			m[k] = l.ID
+		}
+	}
+
+	return m
+}
+
+// ReadLabelAliases reads a JSON file of the form
+// {"aliases": {"Invoice": "Rechnung"}}
+func ReadLabelAliases(file string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f := labelAliasesFile{}
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", file, err)
+	}
+
+	return f.Aliases, nil
+}
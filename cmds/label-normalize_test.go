@@ -0,0 +1,71 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/tochti/docMa-handler/labels"
+)
+
+func Test_LabelNormalizer(t *testing.T) {
+	n := LabelNormalizer{}
+	if n.LabelKey(" Rechnung") != " Rechnung" {
+		t.Fatalf("Expect %q was %q", " Rechnung", n.LabelKey(" Rechnung"))
+	}
+
+	n = LabelNormalizer{Trim: true, Fold: true, NFC: true}.WithAliases(map[string]string{
+		"invoice": "Rechnung",
+	})
+
+	// u followed by a combining diaeresis
+	decomposed := "Bu\u0308cher"
+	for _, c := range []struct {
+		In   string
+		Name string
+		Key  string
+	}{
+		{"Rechnung", "Rechnung", "rechnung"},
+		{"rechnung ", "rechnung", "rechnung"},
+		{" Invoice", "Rechnung", "rechnung"},
+		{decomposed, "Bücher", "bücher"},
+	} {
+		if n.Name(c.In) != c.Name {
+			t.Fatalf("Expect %q was %q", c.Name, n.Name(c.In))
+		}
+		if n.LabelKey(c.In) != c.Key {
+			t.Fatalf("Expect %q was %q", c.Key, n.LabelKey(c.In))
+		}
+	}
+
+	m := n.labelMap([]labels.Label{{1, "Rechnung"}, {2, "rechnung"}, {3, "Bücher"}})
+	expect := map[string]int64{"rechnung": 1, "bücher": 3}
+	if !reflect.DeepEqual(expect, m) {
+		t.Fatalf("Expect %v was %v", expect, m)
+	}
+}
+
+func Test_ReadLabelAliases(t *testing.T) {
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	f := path.Join(td, "aliases.json")
+	err = ioutil.WriteFile(f, []byte(`{"aliases": {"Invoice": "Rechnung"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := ReadLabelAliases(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]string{"Invoice": "Rechnung"}
+	if !reflect.DeepEqual(expect, a) {
+		t.Fatalf("Expect %v was %v", expect, a)
+	}
+}
@@ -0,0 +1,156 @@
+package cmds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	ErrLegacyIDNotFound = errors.New("Legacy id not found")
+)
+
+type (
+	// LegacyID maps the MongoDB _id of a migrated object to its MySQL
+	// id. Kind is the migration stage which wrote the object.
+	LegacyID struct {
+		Kind    string `json:"kind"`
+		MongoID string `json:"mongo_id"`
+		MySQLID int64  `json:"mysql_id"`
+	}
+
+	LegacyIDs []LegacyID
+)
+
+// LookupLegacyID resolves a MongoDB ObjectId to the MySQL ids it was
+// migrated to, or a MySQL id back to its ObjectId. kind restricts the
+// lookup to docs or accounting_data, empty searches both.
+func LookupLegacyID(id, kind string) (Result, error) {
+	result := NewResult()
+
+	if kind != "" && kind != StageDocs && kind != StageAccountingData {
+		err := fmt.Errorf("Unknown kind %v, expect %v or %v", kind, StageDocs, StageAccountingData)
+		return result, NewError(KindConfig, err)
+	}
+
+	column := "mongo_id"
+	var arg interface{} = id
+	if !bson.IsObjectIdHex(id) {
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			err := fmt.Errorf("Expect a MongoDB ObjectId or a MySQL id was %v", id)
+			return result, NewError(KindConfig, err)
+		}
+		column = "mysql_id"
+		arg = n
+	}
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
+
+	// Nothing is migrated yet
+	ok, err := ctrlTableExists(db, LegacyIDsTable)
+	if err != nil {
+		return result, err
+	}
+	if !ok {
+		return result, NewError(KindNotFound, ErrLegacyIDNotFound)
+	}
+
+	q := fmt.Sprintf("SELECT kind, mongo_id, mysql_id FROM %v WHERE %v=?", LegacyIDsTable, column)
+	args := []interface{}{arg}
+	if kind != "" {
+		q += " AND kind=?"
+		args = append(args, kind)
+	}
+	q += " ORDER BY kind"
+
+	rows := []struct {
+		Kind    string `db:"kind"`
+		MongoID string `db:"mongo_id"`
+		MySQLID int64  `db:"mysql_id"`
+	}{}
+	_, err = db.Select(&rows, q, args...)
+	if err != nil {
+		return result, err
+	}
+
+	ids := LegacyIDs{}
+	for _, r := range rows {
+		ids = append(ids, LegacyID{Kind: r.Kind, MongoID: r.MongoID, MySQLID: r.MySQLID})
+	}
+	result.Details = ids
+	result.Add("found", len(ids))
+
+	if len(ids) == 0 {
+		return result, NewError(KindNotFound, ErrLegacyIDNotFound)
+	}
+
+	return result, nil
+}
+
+// readLegacyIDs returns the MySQL ids of all mongoIDs of kind which are
+// already migrated.
+func readLegacyIDs(db gorp.SqlExecutor, kind string, mongoIDs []string) (map[string]int64, error) {
+	r := map[string]int64{}
+	if len(mongoIDs) == 0 {
+		return r, nil
+	}
+
+	rows := []struct {
+		MongoID string `db:"mongo_id"`
+		MySQLID int64  `db:"mysql_id"`
+	}{}
+	q := fmt.Sprintf("SELECT mongo_id, mysql_id FROM %v WHERE kind=? AND mongo_id IN (%v)",
+		LegacyIDsTable, placeholders(len(mongoIDs)))
+	args := []interface{}{kind}
+	for _, id := range mongoIDs {
+		args = append(args, id)
+	}
+
+	_, err := db.Select(&rows, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		r[row.MongoID] = row.MySQLID
+	}
+
+	return r, nil
+}
+
+func saveLegacyIDs(db gorp.SqlExecutor, ids []LegacyID) error {
+	data, err := IfaceSlice(ids)
+	if err != nil {
+		return err
+	}
+
+	fields := []string{"kind", "mongo_id", "mysql_id"}
+	values := func(i interface{}) []interface{} {
+		l := i.(LegacyID)
+		return []interface{}{l.Kind, l.MongoID, l.MySQLID}
+	}
+
+	return batchInsert(db, "INSERT", "", fields, data, LegacyIDsTable, values, Chunker{})
+}
+
+// placeholders returns n comma separated ?.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func (l LegacyIDs) String() string {
+	buf := &bytes.Buffer{}
+	for _, id := range l {
+		fmt.Fprintf(buf, "%v %v -> %v\n", id.Kind, id.MongoID, id.MySQLID)
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,84 @@
+package cmds
+
+import (
+	"errors"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func Test_LookupLegacyID(t *testing.T) {
+	db := initMySQL(t)
+
+	docID := bson.NewObjectId().Hex()
+	accID := bson.NewObjectId().Hex()
+	err := saveLegacyIDs(db, []LegacyID{
+		{Kind: StageDocs, MongoID: docID, MySQLID: 1},
+		{Kind: StageAccountingData, MongoID: accID, MySQLID: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MongoDB id to MySQL id
+	r, err := LookupLegacyID(docID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := r.Details.(LegacyIDs)
+	expect := LegacyID{Kind: StageDocs, MongoID: docID, MySQLID: 1}
+	if len(ids) != 1 || ids[0] != expect {
+		t.Fatalf("Expect %v was %v", expect, ids)
+	}
+
+	// MySQL id back to both MongoDB ids
+	r, err = LookupLegacyID("1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = r.Details.(LegacyIDs)
+	if len(ids) != 2 || ids[0].MongoID != accID || ids[1].MongoID != docID {
+		t.Fatalf("Expect %v was %v", "accounting data and doc", ids)
+	}
+
+	r, err = LookupLegacyID("1", StageAccountingData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = r.Details.(LegacyIDs)
+	expect = LegacyID{Kind: StageAccountingData, MongoID: accID, MySQLID: 1}
+	if len(ids) != 1 || ids[0] != expect {
+		t.Fatalf("Expect %v was %v", expect, ids)
+	}
+
+	_, err = LookupLegacyID(accID, StageDocs)
+	if !errors.Is(err, ErrLegacyIDNotFound) || KindOf(err) != KindNotFound {
+		t.Fatalf("Expect %v was %v", ErrLegacyIDNotFound, err)
+	}
+
+	_, err = LookupLegacyID("foo", "")
+	if KindOf(err) != KindConfig {
+		t.Fatalf("Expect %v was %v", KindConfig, err)
+	}
+}
+
+func Test_LookupLegacyID_NoTable(t *testing.T) {
+	db := initMySQL(t)
+	err := DropCtrlTables(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LookupLegacyID("1", "")
+	if !errors.Is(err, ErrLegacyIDNotFound) || KindOf(err) != KindNotFound {
+		t.Fatalf("Expect %v was %v", ErrLegacyIDNotFound, err)
+	}
+
+	ok, err := ctrlTableExists(db, LegacyIDsTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatalf("Expect %v was %v", false, ok)
+	}
+}
@@ -0,0 +1,122 @@
+package cmds
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/tochti/docMa-handler/accountingData"
+	"github.com/tochti/docMa-handler/docs"
+)
+
+// Stages of the migration in the order they run
+const (
+	StageLabels         = "labels"
+	StageDocs           = "docs"
+	StageAccountingData = "accounting_data"
+)
+
+type (
+	// Checkpoint is the progress of one migration stage. LastID is the
+	// hex Mongo _id of the last migrated object.
+	Checkpoint struct {
+		Stage  string
+		LastID string
+		Done   bool
+	}
+)
+
+// readCheckpoint returns the checkpoint of stage, an empty checkpoint if
+// the stage never ran.
+func readCheckpoint(db gorp.SqlExecutor, stage string) (Checkpoint, error) {
+	cp := Checkpoint{Stage: stage}
+	q := fmt.Sprintf("SELECT last_id, done FROM %v WHERE stage=?", MigrateCheckpointsTable)
+	row := struct {
+		LastID string `db:"last_id"`
+		Done   bool   `db:"done"`
+	}{}
+	err := db.SelectOne(&row, q, stage)
+	if err == sql.ErrNoRows {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+
+	cp.LastID = row.LastID
+	cp.Done = row.Done
+
+	return cp, nil
+}
+
+func saveCheckpoint(db gorp.SqlExecutor, cp Checkpoint) error {
+	q := fmt.Sprintf(`
+	INSERT INTO %v (stage, last_id, done, updated_at) VALUES (?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE last_id=VALUES(last_id), done=VALUES(done), updated_at=VALUES(updated_at)
+	`, MigrateCheckpointsTable)
+	_, err := db.Exec(q, cp.Stage, cp.LastID, cp.Done, time.Now())
+
+	return err
+}
+
+// after returns the Mongo query for all objects after the checkpoint.
+func (cp Checkpoint) after() bson.M {
+	if cp.LastID == "" || !bson.IsObjectIdHex(cp.LastID) {
+		return bson.M{}
+	}
+
+	return bson.M{"_id": bson.M{"$gt": bson.ObjectIdHex(cp.LastID)}}
+}
+
+// clearMigration removes the migrated data and checkpoints from MySQL
+// in one transaction. Only rows with a legacy id and their child rows
+// are removed, docs and accounting data written by imports are kept.
+// Labels are kept too, imported docs may use them.
+func clearMigration(db *gorp.DbMap) error {
+	mapped := fmt.Sprintf("SELECT mysql_id FROM %v WHERE kind=?", LegacyIDsTable)
+	deletes := []struct {
+		Table  string
+		Column string
+		Kind   string
+	}{
+		{docs.DocsLabelsTable, "doc_id", StageDocs},
+		{docs.DocNumbersTable, "doc_id", StageDocs},
+		{docs.DocAccountDataTable, "doc_id", StageDocs},
+		{DocHashesTable, "doc_id", StageDocs},
+		{docs.DocsTable, "id", StageDocs},
+		{TxsKeysTable, "accounting_data_id", StageAccountingData},
+		{accountingData.AccountingDataTable, "id", StageAccountingData},
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deletes {
+		q := fmt.Sprintf("DELETE FROM %v WHERE %v IN (%v)", d.Table, d.Column, mapped)
+		_, err = tx.Exec(q, d.Kind)
+		if err != nil {
+			break
+		}
+	}
+	for _, t := range []string{LegacyIDsTable, MigrateCheckpointsTable} {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("DELETE FROM " + t)
+	}
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
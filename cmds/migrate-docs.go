@@ -0,0 +1,276 @@
+package cmds
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2"
+
+	"github.com/tochti/docMa-handler/docs"
+	"github.com/tochti/docMa-handler/labels"
+)
+
+const (
+	defaultMigrateWorkers   = 4
+	defaultMigrateBatchSize = 100
+)
+
+type (
+	docBatch struct {
+		Seq  int
+		Docs []Doc
+	}
+
+	docBatchDone struct {
+		Seq    int
+		LastID string
+		Docs   int
+		Err    error
+	}
+)
+
+// MigrateDocs streams the docs sorted by _id from MongoDB and writes
+// them in batches with opts.Workers transactions at once. Every batch
+// records the Mongo ids of its docs in the legacy ids table, the
+// checkpoint is moved forward when all batches before are committed.
+// On resume docs after the checkpoint with a legacy id are skipped.
+func MigrateDocs(sqlDB *gorp.DbMap, mgoDB *mgo.Database, opts MigrateOpts) error {
+	opts = opts.withDefaults()
+
+	ll := []labels.Label{}
+	q := fmt.Sprintf("SELECT * FROM %v", labels.LabelsTable)
+	_, err := sqlDB.Select(&ll, q)
+	if err != nil {
+		return err
+	}
+	lMap := opts.Labels.labelMap(ll)
+
+	cp, err := readCheckpoint(sqlDB, StageDocs)
+	if err != nil {
+		return err
+	}
+
+	query := mgoDB.C(DocsColl).Find(cp.after()).Sort("_id")
+	total, err := query.Count()
+	if err != nil {
+		return err
+	}
+	prog := newProgress(opts.Progress, StageDocs, total)
+
+	batches := make(chan docBatch)
+	results := make(chan docBatchDone)
+	quit := make(chan struct{})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				n, err := migrateDocBatch(sqlDB, b.Docs, lMap, opts.Labels)
+				results <- docBatchDone{
+					Seq:    b.Seq,
+					LastID: b.Docs[len(b.Docs)-1].ID.Hex(),
+					Docs:   n,
+					Err:    err,
+				}
+			}
+		}()
+	}
+
+	// Read the cursor while the workers write
+	var iterErr error
+	go func() {
+		defer close(batches)
+
+		iter := query.Batch(opts.BatchSize).Iter()
+		seq := 0
+		batch := []Doc{}
+		send := func() bool {
+			select {
+			case batches <- docBatch{Seq: seq, Docs: batch}:
+				seq++
+				batch = []Doc{}
+				return true
+			case <-quit:
+				return false
+			}
+		}
+
+		d := Doc{}
+		for iter.Next(&d) {
+			batch = append(batch, d)
+			d = Doc{}
+			if len(batch) >= opts.BatchSize && !send() {
+				iter.Close()
+				return
+			}
+		}
+		iterErr = iter.Close()
+		if iterErr == nil && len(batch) > 0 {
+			send()
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Batches finish out of order, the checkpoint only moves over
+	// batches without a gap before them.
+	var firstErr error
+	finished := map[int]string{}
+	next := 0
+	for r := range results {
+		if r.Err != nil {
+			if firstErr == nil {
+				firstErr = r.Err
+				close(quit)
+			}
+			continue
+		}
+		prog.Add(r.Docs)
+
+		finished[r.Seq] = r.LastID
+		moved := false
+		for {
+			id, ok := finished[next]
+			if !ok {
+				break
+			}
+			delete(finished, next)
+			cp.LastID = id
+			next++
+			moved = true
+		}
+		if moved {
+			err := saveCheckpoint(sqlDB, cp)
+			if err != nil && firstErr == nil {
+				firstErr = err
+				close(quit)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return iterErr
+}
+
+// migrateDocBatch writes docs with their doc numbers, account data,
+// labels and legacy ids in one transaction. Docs which already have a
+// legacy id are skipped. It returns the number of docs in the batch.
+func migrateDocBatch(sqlDB *gorp.DbMap, mDocs []Doc, lMap map[string]int64, n LabelNormalizer) (int, error) {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	err = writeDocBatch(sqlDB, tx, mDocs, lMap, n)
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
+		}
+		return 0, err
+	}
+
+	return len(mDocs), tx.Commit()
+}
+
+// writeDocBatch joins the docs with the labels in lMap, keyed by the
+// LabelKey of n.
+func writeDocBatch(sqlDB *gorp.DbMap, exec gorp.SqlExecutor, mDocs []Doc, lMap map[string]int64, n LabelNormalizer) error {
+	ids := []string{}
+	for _, d := range mDocs {
+		ids = append(ids, d.ID.Hex())
+	}
+	migrated, err := readLegacyIDs(exec, StageDocs, ids)
+	if err != nil {
+		return err
+	}
+
+	docNumbers := []docs.DocNumber{}
+	accountData := []docs.DocAccountData{}
+	docsLabels := []docs.DocsLabels{}
+	legacy := []LegacyID{}
+	for _, mDoc := range mDocs {
+		if _, ok := migrated[mDoc.ID.Hex()]; ok {
+			continue
+		}
+
+		doc := docs.Doc{
+			Name:          mDoc.Name,
+			Barcode:       mDoc.Barcode,
+			Note:          string(mDoc.Note),
+			DateOfScan:    mDoc.Infos.DateOfScan,
+			DateOfReceipt: mDoc.Infos.DateOfReceipt,
+		}
+		err := exec.Insert(&doc)
+		if err != nil {
+			return err
+		}
+
+		legacy = append(legacy, LegacyID{Kind: StageDocs, MongoID: mDoc.ID.Hex(), MySQLID: doc.ID})
+
+		for _, dn := range mDoc.AccountData.DocNumbers {
+			docNumbers = append(docNumbers, docs.DocNumber{DocID: doc.ID, Number: dn})
+		}
+
+		accountData = append(accountData, docs.DocAccountData{
+			DocID:         doc.ID,
+			AccountNumber: mDoc.AccountData.AccNumber,
+			PeriodFrom:    mDoc.AccountData.DocPeriod.From,
+			PeriodTo:      mDoc.AccountData.DocPeriod.To,
+		})
+
+		for _, v := range mDoc.Labels {
+			id, ok := lMap[n.LabelKey(v)]
+			if !ok {
+				return fmt.Errorf("Missing label %v", v)
+			}
+
+			docsLabels = append(docsLabels, docs.DocsLabels{
+				DocID:   doc.ID,
+				LabelID: id,
+			})
+		}
+	}
+
+	w := NewBulkWriter(sqlDB, exec, BulkInsert)
+	err = w.Write(docNumbers)
+	if err != nil {
+		return err
+	}
+
+	err = w.Write(accountData)
+	if err != nil {
+		return err
+	}
+
+	// A doc can have the same label twice in MongoDB or two names
+	// merged into one label
+	w.Mode = BulkInsertIgnore
+	err = w.Write(docsLabels)
+	if err != nil {
+		return err
+	}
+
+	return saveLegacyIDs(exec, legacy)
+}
+
+func (opts MigrateOpts) withDefaults() MigrateOpts {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultMigrateWorkers
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultMigrateBatchSize
+	}
+
+	return opts
+}
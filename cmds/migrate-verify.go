@@ -0,0 +1,573 @@
+package cmds
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/tochti/docMa-handler/accountingData"
+	"github.com/tochti/docMa-handler/docs"
+	"github.com/tochti/docMa-handler/labels"
+)
+
+// Kinds of mismatches found by VerifyMigration
+const (
+	MismatchMissing   = "missing"
+	MismatchExtra     = "extra"
+	MismatchDifferent = "different"
+)
+
+const (
+	// verifyBatchSize is the number of MySQL rows read per page
+	verifyBatchSize = 1000
+)
+
+type (
+	// Mismatch is one difference between MongoDB and MySQL. Object is
+	// doc, label or accounting_data, Key identifies the object.
+	Mismatch struct {
+		Kind   string `json:"kind"`
+		Object string `json:"object"`
+		Key    string `json:"key"`
+		Field  string `json:"field,omitempty"`
+		Mongo  string `json:"mongo,omitempty"`
+		MySQL  string `json:"mysql,omitempty"`
+	}
+
+	VerifyReport struct {
+		Mismatches []Mismatch `json:"mismatches"`
+	}
+
+	// migratedDoc is a doc with all its rows from MySQL. MongoID is
+	// the legacy id of the doc, empty if it has none.
+	migratedDoc struct {
+		docs.Doc
+		MongoID     string `db:"mongo_id"`
+		AccountData docs.DocAccountData
+		Numbers     []string
+		Labels      []string
+	}
+
+	// migratedAcc is an accounting data row with its legacy id.
+	migratedAcc struct {
+		accountingData.AccountingData
+		MongoID string `db:"mongo_id"`
+	}
+
+	// legacyPages builds the queries to read a MySQL table page by page
+	// in the order of the legacy ids. The rows without a legacy id come
+	// first, they are read by their id.
+	legacyPages struct {
+		kind         string
+		table        string
+		mapped       bool
+		afterID      int64
+		afterMongoID string
+		done         bool
+	}
+
+	// verifier merge-compares the sorted records of both sides.
+	verifier struct {
+		n          LabelNormalizer
+		result     Result
+		mismatches []Mismatch
+		// labels are the label keys of all MongoDB docs
+		labels map[string]bool
+	}
+)
+
+// VerifyMigration compares the docs, labels and accounting data in
+// MongoDB with the migrated data in MySQL. Docs and accounting data are
+// paired by their legacy ids, both sides are streamed in the order of
+// the MongoDB ids. Labels are compared by the LabelKey of n, it should
+// be the normalizer used by the migration. All mismatches are reported
+// in the details, the error is set if there is at least one.
+func VerifyMigration(n LabelNormalizer) (Result, error) {
+	v := newVerifier(n)
+
+	sqlDB, err := openMySQL()
+	if err != nil {
+		return v.result, err
+	}
+	docs.AddTables(sqlDB)
+	labels.AddTables(sqlDB)
+	accountingData.AddTables(sqlDB)
+
+	mgoSession, mgoSpecs, err := dialMongoDB()
+	if err != nil {
+		return v.result, err
+	}
+	defer mgoSession.Close()
+	mgoDB := mgoSession.DB(mgoSpecs.DBName)
+
+	iter := mgoDB.C(DocsColl).Find(bson.M{}).Sort("_id").Batch(verifyBatchSize).Iter()
+	defer iter.Close()
+	mongoDocs := func() (*Doc, error) {
+		d := &Doc{}
+		if iter.Next(d) {
+			return d, nil
+		}
+		return nil, iter.Close()
+	}
+	sqlDocs := newLegacyPages(StageDocs, docs.DocsTable)
+	err = v.verifyDocs(mongoDocs, func() ([]*migratedDoc, error) {
+		return readMigratedDocPage(sqlDB, sqlDocs)
+	})
+	if err != nil {
+		return v.result, err
+	}
+
+	sLabels := []labels.Label{}
+	_, err = sqlDB.Select(&sLabels, fmt.Sprintf("SELECT * FROM %v", labels.LabelsTable))
+	if err != nil {
+		return v.result, err
+	}
+	v.verifyLabels(sLabels)
+
+	accIter := mgoDB.C(AccountingDataColl).Find(bson.M{}).Sort("_id").Batch(verifyBatchSize).Iter()
+	defer accIter.Close()
+	mongoAcc := func() (*AccProcess, error) {
+		a := &AccProcess{}
+		if accIter.Next(a) {
+			return a, nil
+		}
+		return nil, accIter.Close()
+	}
+	sqlAcc := newLegacyPages(StageAccountingData, accountingData.AccountingDataTable)
+	err = v.verifyAccountingData(mongoAcc, func() ([]*migratedAcc, error) {
+		return readMigratedAccPage(sqlDB, sqlAcc)
+	})
+	if err != nil {
+		return v.result, err
+	}
+
+	return v.done()
+}
+
+func newVerifier(n LabelNormalizer) *verifier {
+	v := &verifier{
+		n:          n,
+		result:     NewResult(),
+		mismatches: []Mismatch{},
+		labels:     map[string]bool{},
+	}
+	v.result.Details = VerifyReport{Mismatches: v.mismatches}
+	for _, c := range []string{"mongo_docs", "mysql_docs", "mongo_accounting_data", "mysql_accounting_data"} {
+		v.result.Add(c, 0)
+	}
+
+	return v
+}
+
+// done returns the result with the report of all mismatches.
+func (v *verifier) done() (Result, error) {
+	v.result.Details = VerifyReport{Mismatches: v.mismatches}
+	v.result.Add("mismatches", len(v.mismatches))
+
+	if len(v.mismatches) > 0 {
+		return v.result, fmt.Errorf("Found %v mismatches", len(v.mismatches))
+	}
+
+	return v.result, nil
+}
+
+func (v *verifier) add(m Mismatch) {
+	v.mismatches = append(v.mismatches, m)
+}
+
+// diff adds a mismatch for field if the values differ.
+func (v *verifier) diff(object, key, field string, mongo, mysql interface{}) {
+	mv, sv := fmt.Sprint(mongo), fmt.Sprint(mysql)
+	if mv != sv {
+		v.add(Mismatch{
+			Kind:   MismatchDifferent,
+			Object: object,
+			Key:    key,
+			Field:  field,
+			Mongo:  mv,
+			MySQL:  sv,
+		})
+	}
+}
+
+// verifyDocs compares the MongoDB docs of nextMongo, sorted by _id, with
+// the pages of MySQL docs of nextPage, sorted by their legacy ids. Both
+// return nil at the end. Mismatches are keyed by the doc name.
+func (v *verifier) verifyDocs(nextMongo func() (*Doc, error), nextPage func() ([]*migratedDoc, error)) error {
+	page := []*migratedDoc{}
+	nextSQL := func() (*migratedDoc, error) {
+		if len(page) == 0 {
+			var err error
+			page, err = nextPage()
+			if err != nil || len(page) == 0 {
+				return nil, err
+			}
+		}
+		d := page[0]
+		page = page[1:]
+		v.result.Add("mysql_docs", 1)
+		return d, nil
+	}
+	nextM := func() (*Doc, error) {
+		d, err := nextMongo()
+		if d != nil {
+			v.result.Add("mongo_docs", 1)
+			for _, l := range d.Labels {
+				v.labels[v.n.LabelKey(l)] = true
+			}
+		}
+		return d, err
+	}
+
+	m, err := nextM()
+	if err != nil {
+		return err
+	}
+	s, err := nextSQL()
+	if err != nil {
+		return err
+	}
+
+	for m != nil || s != nil {
+		switch {
+		case s != nil && (m == nil || s.MongoID < m.ID.Hex()):
+			v.add(Mismatch{Kind: MismatchExtra, Object: "doc", Key: s.Name})
+			s, err = nextSQL()
+		case m != nil && (s == nil || m.ID.Hex() < s.MongoID):
+			v.add(Mismatch{Kind: MismatchMissing, Object: "doc", Key: m.Name})
+			m, err = nextM()
+		default:
+			v.compareDoc(m, s)
+			m, err = nextM()
+			if err == nil {
+				s, err = nextSQL()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) compareDoc(m *Doc, s *migratedDoc) {
+	diff := func(field string, mongo, mysql interface{}) {
+		v.diff("doc", m.Name, field, mongo, mysql)
+	}
+
+	diff("name", m.Name, s.Name)
+	diff("barcode", m.Barcode, s.Barcode)
+	diff("note", string(m.Note), s.Note)
+	diff("date_of_scan", verifyTime(m.Infos.DateOfScan), verifyTime(s.DateOfScan))
+	diff("date_of_receipt", verifyTime(m.Infos.DateOfReceipt), verifyTime(s.DateOfReceipt))
+	diff("account_number", m.AccountData.AccNumber, s.AccountData.AccountNumber)
+	diff("period_from", verifyTime(m.AccountData.DocPeriod.From), verifyTime(s.AccountData.PeriodFrom))
+	diff("period_to", verifyTime(m.AccountData.DocPeriod.To), verifyTime(s.AccountData.PeriodTo))
+	diff("doc_numbers", verifySet(m.AccountData.DocNumbers), verifySet(s.Numbers))
+	diff("labels", verifySet(labelKeys(m.Labels, v.n)), verifySet(labelKeys(s.Labels, v.n)))
+}
+
+// verifyLabels checks that there is a label for all label keys of the
+// MongoDB docs and no label without one, verifyDocs has to run first.
+func (v *verifier) verifyLabels(sLabels []labels.Label) {
+	s := map[string]bool{}
+	extra := []string{}
+	for _, l := range sLabels {
+		k := v.n.LabelKey(l.Name)
+		if !s[k] && !v.labels[k] {
+			extra = append(extra, l.Name)
+		}
+		s[k] = true
+	}
+	sort.Strings(extra)
+
+	mLabels := []string{}
+	for l := range v.labels {
+		mLabels = append(mLabels, l)
+	}
+	sort.Strings(mLabels)
+
+	v.result.Add("mongo_labels", len(mLabels))
+	v.result.Add("mysql_labels", len(sLabels))
+	for _, l := range mLabels {
+		if !s[l] {
+			v.add(Mismatch{Kind: MismatchMissing, Object: "label", Key: l})
+		}
+	}
+	for _, l := range extra {
+		v.add(Mismatch{Kind: MismatchExtra, Object: "label", Key: l})
+	}
+}
+
+// verifyAccountingData compares the records like verifyDocs. Mismatches
+// are keyed by the MongoDB id, extra MySQL rows by their id.
+func (v *verifier) verifyAccountingData(nextMongo func() (*AccProcess, error), nextPage func() ([]*migratedAcc, error)) error {
+	page := []*migratedAcc{}
+	nextSQL := func() (*migratedAcc, error) {
+		if len(page) == 0 {
+			var err error
+			page, err = nextPage()
+			if err != nil || len(page) == 0 {
+				return nil, err
+			}
+		}
+		a := page[0]
+		page = page[1:]
+		v.result.Add("mysql_accounting_data", 1)
+		return a, nil
+	}
+	nextM := func() (*AccProcess, error) {
+		a, err := nextMongo()
+		if a != nil {
+			v.result.Add("mongo_accounting_data", 1)
+		}
+		return a, err
+	}
+
+	m, err := nextM()
+	if err != nil {
+		return err
+	}
+	s, err := nextSQL()
+	if err != nil {
+		return err
+	}
+
+	for m != nil || s != nil {
+		switch {
+		case s != nil && (m == nil || s.MongoID < m.ID.Hex()):
+			v.add(Mismatch{Kind: MismatchExtra, Object: "accounting_data", Key: fmt.Sprint(s.ID)})
+			s, err = nextSQL()
+		case m != nil && (s == nil || m.ID.Hex() < s.MongoID):
+			v.add(Mismatch{Kind: MismatchMissing, Object: "accounting_data", Key: m.ID.Hex()})
+			m, err = nextM()
+		default:
+			v.compareAccountingData(m, s)
+			m, err = nextM()
+			if err == nil {
+				s, err = nextSQL()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (v *verifier) compareAccountingData(m *AccProcess, s *migratedAcc) {
+	diff := func(field string, mongo, mysql interface{}) {
+		v.diff("accounting_data", m.ID.Hex(), field, mongo, mysql)
+	}
+	amount := func(field string, mongo, mysql float64) {
+		if math.Abs(mongo-mysql) >= 0.005 {
+			diff(field, fmt.Sprintf("%.2f", mongo), fmt.Sprintf("%.2f", mysql))
+		}
+	}
+
+	diff("doc_date", verifyTime(m.DocDate), verifyTime(s.DocDate))
+	diff("date_of_entry", verifyTime(m.DateOfEntry), verifyTime(s.DateOfEntry))
+	diff("doc_number_range", m.DocNumberRange, s.DocNumberRange)
+	diff("doc_number", m.DocNumber, s.DocNumber)
+	diff("posting_text", m.PostingText, s.PostingText)
+	diff("debit_account", m.DebitAcc, s.DebitAccount)
+	diff("credit_account", m.CreditAcc, s.CreditAccount)
+	amount("amount_posted", m.AmountPosted, s.AmountPosted)
+	amount("amount_posted_euro", m.AmountPostedEuro, s.AmountPostedEuro)
+	diff("currency", m.Currency, s.Currency)
+	diff("tax_code", m.TaxCode, s.TaxCode)
+	diff("cost_unit1", m.CostUnit1, s.CostUnit1)
+	diff("cost_unit2", m.CostUnit2, s.CostUnit2)
+}
+
+func newLegacyPages(kind, table string) *legacyPages {
+	return &legacyPages{kind: kind, table: table}
+}
+
+// query returns the query of the next page, the rows have the columns
+// of the table and mongo_id.
+func (p *legacyPages) query() (string, []interface{}) {
+	if !p.mapped {
+		q := fmt.Sprintf(`
+			SELECT t.*, '' AS mongo_id FROM %v AS t
+			LEFT JOIN %v AS l ON l.kind=? AND l.mysql_id=t.id
+			WHERE l.mysql_id IS NULL AND t.id>?
+			ORDER BY t.id LIMIT %v`,
+			p.table, LegacyIDsTable, verifyBatchSize)
+		return q, []interface{}{p.kind, p.afterID}
+	}
+
+	q := fmt.Sprintf(`
+		SELECT t.*, l.mongo_id FROM %v AS l, %v AS t
+		WHERE l.kind=? AND l.mongo_id>? AND t.id=l.mysql_id
+		ORDER BY l.mongo_id LIMIT %v`,
+		LegacyIDsTable, p.table, verifyBatchSize)
+	return q, []interface{}{p.kind, p.afterMongoID}
+}
+
+// read moves behind the page of n rows ending with the row id and
+// mongoID.
+func (p *legacyPages) read(n int, id int64, mongoID string) {
+	if !p.mapped {
+		p.afterID = id
+		p.mapped = n < verifyBatchSize
+		return
+	}
+
+	p.afterMongoID = mongoID
+	p.done = n < verifyBatchSize
+}
+
+// readMigratedDocPage returns the next page of docs of p, empty after
+// the last page.
+func readMigratedDocPage(db gorp.SqlExecutor, p *legacyPages) ([]*migratedDoc, error) {
+	for !p.done {
+		rows := []*migratedDoc{}
+		q, args := p.query()
+		_, err := db.Select(&rows, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			p.read(0, 0, "")
+			continue
+		}
+
+		last := rows[len(rows)-1]
+		p.read(len(rows), last.ID, last.MongoID)
+		return rows, readDocRows(db, rows)
+	}
+
+	return nil, nil
+}
+
+// readMigratedAccPage returns the next page of accounting data of p,
+// empty after the last page.
+func readMigratedAccPage(db gorp.SqlExecutor, p *legacyPages) ([]*migratedAcc, error) {
+	for !p.done {
+		rows := []*migratedAcc{}
+		q, args := p.query()
+		_, err := db.Select(&rows, q, args...)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 {
+			p.read(0, 0, "")
+			continue
+		}
+
+		last := rows[len(rows)-1]
+		p.read(len(rows), last.ID, last.MongoID)
+		return rows, nil
+	}
+
+	return nil, nil
+}
+
+// readDocRows reads the account data, doc numbers and labels of dd.
+func readDocRows(db gorp.SqlExecutor, dd []*migratedDoc) error {
+	if len(dd) == 0 {
+		return nil
+	}
+
+	byID := map[int64]*migratedDoc{}
+	args := []interface{}{}
+	for _, d := range dd {
+		d.Numbers = []string{}
+		d.Labels = []string{}
+		byID[d.ID] = d
+		args = append(args, d.ID)
+	}
+	in := placeholders(len(dd))
+
+	ad := []docs.DocAccountData{}
+	q := fmt.Sprintf("SELECT * FROM %v WHERE doc_id IN (%v)", docs.DocAccountDataTable, in)
+	_, err := db.Select(&ad, q, args...)
+	if err != nil {
+		return err
+	}
+	for _, a := range ad {
+		byID[a.DocID].AccountData = a
+	}
+
+	dn := []docs.DocNumber{}
+	q = fmt.Sprintf("SELECT * FROM %v WHERE doc_id IN (%v)", docs.DocNumbersTable, in)
+	_, err = db.Select(&dn, q, args...)
+	if err != nil {
+		return err
+	}
+	for _, n := range dn {
+		byID[n.DocID].Numbers = append(byID[n.DocID].Numbers, n.Number)
+	}
+
+	dl := []struct {
+		DocID int64  `db:"doc_id"`
+		Name  string `db:"name"`
+	}{}
+	q = fmt.Sprintf(`
+	SELECT %v.doc_id, %v.name FROM %v, %v
+	WHERE %v.label_id=%v.id AND %v.doc_id IN (%v)
+	`, docs.DocsLabelsTable, labels.LabelsTable,
+		docs.DocsLabelsTable, labels.LabelsTable,
+		docs.DocsLabelsTable, labels.LabelsTable,
+		docs.DocsLabelsTable, in)
+	_, err = db.Select(&dl, q, args...)
+	if err != nil {
+		return err
+	}
+	for _, l := range dl {
+		byID[l.DocID].Labels = append(byID[l.DocID].Labels, l.Name)
+	}
+
+	return nil
+}
+
+func verifyTime(t time.Time) string {
+	return t.UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+func labelKeys(l []string, n LabelNormalizer) []string {
+	r := []string{}
+	for _, name := range l {
+		r = append(r, n.LabelKey(name))
+	}
+
+	return r
+}
+
+func verifySet(l []string) string {
+	s := append([]string{}, l...)
+	RemoveDuplicates(&s)
+	sort.Strings(s)
+
+	return strings.Join(s, ", ")
+}
+
+func (r VerifyReport) String() string {
+	buf := &bytes.Buffer{}
+	if len(r.Mismatches) == 0 {
+		return ""
+	}
+
+	fmt.Fprintf(buf, "Mismatches (%v):\n", len(r.Mismatches))
+	for _, m := range r.Mismatches {
+		switch m.Kind {
+		case MismatchDifferent:
+			fmt.Fprintf(buf, "  ~ %v %v: %v mongo=%q mysql=%q\n", m.Object, m.Key, m.Field, m.Mongo, m.MySQL)
+		case MismatchMissing:
+			fmt.Fprintf(buf, "  - %v %v missing in MySQL\n", m.Object, m.Key)
+		default:
+			fmt.Fprintf(buf, "  + %v %v only in MySQL\n", m.Object, m.Key)
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,301 @@
+package cmds
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/gorp.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/tochti/docMa-handler/accountingData"
+	"github.com/tochti/docMa-handler/docs"
+	"github.com/tochti/docMa-handler/labels"
+)
+
+func Test_VerifyDocs(t *testing.T) {
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	id1 := bson.ObjectIdHex("000000000000000000000001")
+	id2 := bson.ObjectIdHex("000000000000000000000002")
+	mDocs := []*Doc{
+		{
+			ID:      id1,
+			Name:    "Name-1",
+			Barcode: "Barcode-1",
+			Labels:  []string{"l1", "l2"},
+			Infos:   DocInfos{DateOfScan: d, DateOfReceipt: d},
+			AccountData: DocAccountData{
+				DocNumbers: []string{"DN1"},
+				AccNumber:  1,
+			},
+		},
+		{ID: id2, Name: "Name-2"},
+	}
+	// Docs without legacy id come first
+	sDocs := [][]*migratedDoc{
+		{
+			{Doc: docs.Doc{Name: "Name-3"}},
+			{
+				Doc:         docs.Doc{1, "Name-1", "Barcode-1", d.Local(), d, ""},
+				MongoID:     id1.Hex(),
+				AccountData: docs.DocAccountData{1, time.Time{}, time.Time{}, 1},
+				Numbers:     []string{"DN1"},
+				Labels:      []string{"l2"},
+			},
+		},
+	}
+
+	v := newVerifier(LabelNormalizer{})
+	err := v.verifyDocs(nextDocs(mDocs), nextMigratedDocs(sDocs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []Mismatch{
+		{Kind: MismatchExtra, Object: "doc", Key: "Name-3"},
+		{Kind: MismatchDifferent, Object: "doc", Key: "Name-1", Field: "labels", Mongo: "l1, l2", MySQL: "l2"},
+		{Kind: MismatchMissing, Object: "doc", Key: "Name-2"},
+	}
+	if len(v.mismatches) != len(expect) {
+		t.Fatalf("Expect %v was %v", expect, v.mismatches)
+	}
+	for i, m := range expect {
+		if v.mismatches[i] != m {
+			t.Fatalf("Expect %v was %v", m, v.mismatches[i])
+		}
+	}
+
+	if v.result.Counts["mongo_docs"] != 2 || v.result.Counts["mysql_docs"] != 2 {
+		t.Fatalf("Expect %v was %v", "2 docs each", v.result.Counts)
+	}
+
+	if !v.labels["l1"] || !v.labels["l2"] {
+		t.Fatalf("Expect %v was %v", "l1 and l2", v.labels)
+	}
+}
+
+func Test_VerifyLabels(t *testing.T) {
+	v := newVerifier(LabelNormalizer{})
+	v.labels = map[string]bool{"l1": true, "l2": true}
+	v.verifyLabels([]labels.Label{{ID: 1, Name: "l3"}, {ID: 2, Name: "l1"}})
+
+	expect := []Mismatch{
+		{Kind: MismatchMissing, Object: "label", Key: "l2"},
+		{Kind: MismatchExtra, Object: "label", Key: "l3"},
+	}
+	if len(v.mismatches) != len(expect) {
+		t.Fatalf("Expect %v was %v", expect, v.mismatches)
+	}
+	for i, m := range expect {
+		if v.mismatches[i] != m {
+			t.Fatalf("Expect %v was %v", m, v.mismatches[i])
+		}
+	}
+}
+
+func Test_VerifyAccountingData(t *testing.T) {
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	id1 := bson.ObjectIdHex("000000000000000000000001")
+	id2 := bson.ObjectIdHex("000000000000000000000002")
+	id3 := bson.ObjectIdHex("000000000000000000000003")
+	mAcc := []*AccProcess{
+		{ID: id1, DocDate: d, DateOfEntry: d, DocNumber: "1", AmountPosted: 1.1, DebitAcc: 1400, CreditAcc: 1500},
+		{ID: id2, DocDate: d, DateOfEntry: d, DocNumber: "1", AmountPosted: 1.1, DebitAcc: 1400, CreditAcc: 1500},
+		{ID: id3, DocDate: d, DateOfEntry: d, DocNumber: "2", AmountPosted: 2.0},
+	}
+	// Paged like legacyPages, the same booking twice is paired by id
+	sAcc := [][]*migratedAcc{
+		{
+			{AccountingData: accountingData.AccountingData{ID: 3, DocDate: d, DateOfEntry: d, DocNumber: "3"}},
+		},
+		{
+			{
+				AccountingData: accountingData.AccountingData{ID: 1, DocDate: d, DateOfEntry: d, DocNumber: "1", AmountPosted: 1.1, DebitAccount: 1400, CreditAccount: 1500},
+				MongoID:        id2.Hex(),
+			},
+			{
+				AccountingData: accountingData.AccountingData{ID: 2, DocDate: d, DateOfEntry: d, DocNumber: "2", AmountPosted: 2.5},
+				MongoID:        id3.Hex(),
+			},
+		},
+	}
+
+	v := newVerifier(LabelNormalizer{})
+	err := v.verifyAccountingData(nextAccProcesses(mAcc), nextMigratedAcc(sAcc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []Mismatch{
+		{Kind: MismatchExtra, Object: "accounting_data", Key: "3"},
+		{Kind: MismatchMissing, Object: "accounting_data", Key: id1.Hex()},
+		{
+			Kind:   MismatchDifferent,
+			Object: "accounting_data",
+			Key:    id3.Hex(),
+			Field:  "amount_posted",
+			Mongo:  "2.00",
+			MySQL:  "2.50",
+		},
+	}
+	if len(v.mismatches) != len(expect) {
+		t.Fatalf("Expect %v was %v", expect, v.mismatches)
+	}
+	for i, m := range expect {
+		if v.mismatches[i] != m {
+			t.Fatalf("Expect %v was %v", m, v.mismatches[i])
+		}
+	}
+
+	_, err = v.done()
+	if err == nil || v.result.Counts["mismatches"] != 3 {
+		t.Fatalf("Expect %v was %v", 3, v.result.Counts["mismatches"])
+	}
+}
+
+func Test_VerifyMigration(t *testing.T) {
+	sqlDB, mgoDB := initDB(t)
+	defer sqlDB.Db.Close()
+	defer mgoDB.Session.Close()
+
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := mgoDB.C(DocsColl).Insert(Doc{
+		ID:     bson.NewObjectId(),
+		Name:   "Name-1",
+		Labels: []string{"l1"},
+		Infos:  DocInfos{DateOfScan: d, DateOfReceipt: d},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same booking twice
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId()}
+	for _, id := range ids {
+		err := mgoDB.C(AccountingDataColl).Insert(AccProcess{
+			ID:           id,
+			DocDate:      d,
+			DateOfEntry:  d,
+			DocNumber:    "1",
+			AmountPosted: 1.1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := MigrateOpts{}
+	for _, m := range []func(*gorp.DbMap, *mgo.Database, MigrateOpts) error{
+		MigrateLabels, MigrateDocs, MigrateAccountingData,
+	} {
+		err := m(sqlDB, mgoDB, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := VerifyMigration(LabelNormalizer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Counts["mysql_accounting_data"] != 2 || r.Counts["mysql_docs"] != 1 {
+		t.Fatalf("Expect %v was %v", "1 doc and 2 accounting data", r.Counts)
+	}
+
+	id, err := sqlDB.SelectInt("SELECT mysql_id FROM legacy_ids WHERE mongo_id=?", ids[1].Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqlDB.Exec("UPDATE accounting_data SET amount_posted=2 WHERE id=?", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = VerifyMigration(LabelNormalizer{})
+	if err == nil {
+		t.Fatalf("Expect %v was %v", "error", err)
+	}
+	expect := Mismatch{
+		Kind:   MismatchDifferent,
+		Object: "accounting_data",
+		Key:    ids[1].Hex(),
+		Field:  "amount_posted",
+		Mongo:  "1.10",
+		MySQL:  "2.00",
+	}
+	m := r.Details.(VerifyReport).Mismatches
+	if len(m) != 1 || m[0] != expect {
+		t.Fatalf("Expect %v was %v", expect, m)
+	}
+}
+
+func Test_LegacyPages(t *testing.T) {
+	p := newLegacyPages(StageDocs, docs.DocsTable)
+
+	p.read(verifyBatchSize, 1000, "")
+	_, args := p.query()
+	if p.mapped || args[1] != int64(1000) {
+		t.Fatalf("Expect %v was %v", 1000, args)
+	}
+
+	p.read(1, 1001, "")
+	_, args = p.query()
+	if !p.mapped || args[1] != "" {
+		t.Fatalf("Expect %v was %v", "mapped", args)
+	}
+
+	p.read(verifyBatchSize, 7, "00000000000000000000000a")
+	_, args = p.query()
+	if p.done || args[1] != "00000000000000000000000a" {
+		t.Fatalf("Expect %v was %v", "00000000000000000000000a", args)
+	}
+
+	p.read(0, 0, "")
+	if !p.done {
+		t.Fatalf("Expect %v was %v", true, p.done)
+	}
+}
+
+func nextDocs(l []*Doc) func() (*Doc, error) {
+	return func() (*Doc, error) {
+		if len(l) == 0 {
+			return nil, nil
+		}
+		d := l[0]
+		l = l[1:]
+		return d, nil
+	}
+}
+
+func nextAccProcesses(l []*AccProcess) func() (*AccProcess, error) {
+	return func() (*AccProcess, error) {
+		if len(l) == 0 {
+			return nil, nil
+		}
+		a := l[0]
+		l = l[1:]
+		return a, nil
+	}
+}
+
+func nextMigratedDocs(pages [][]*migratedDoc) func() ([]*migratedDoc, error) {
+	return func() ([]*migratedDoc, error) {
+		if len(pages) == 0 {
+			return nil, nil
+		}
+		p := pages[0]
+		pages = pages[1:]
+		return p, nil
+	}
+}
+
+func nextMigratedAcc(pages [][]*migratedAcc) func() ([]*migratedAcc, error) {
+	return func() ([]*migratedAcc, error) {
+		if len(pages) == 0 {
+			return nil, nil
+		}
+		p := pages[0]
+		pages = pages[1:]
+		return p, nil
+	}
+}
@@ -1,9 +1,8 @@
 package cmds
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
+	"io"
 	"log"
 	"reflect"
 	"time"
@@ -12,9 +11,7 @@ import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
-	"github.com/kelseyhightower/envconfig"
 	"github.com/tochti/docMa-handler/accountingData"
-	"github.com/tochti/docMa-handler/common"
 	"github.com/tochti/docMa-handler/docs"
 	"github.com/tochti/docMa-handler/labels"
 )
@@ -24,10 +21,24 @@ var (
 	AccountingDataColl = "AccProcess"
 )
 
+const (
+	// Accounting data records written per transaction
+	accBatchSize = 1000
+)
+
 type (
-	MongoDBSpecs struct {
-		Host   string `envconfig:"MONGODB_HOST"`
-		DBName string `envconfig:"MONGODB_DB_NAME"`
+	MigrateOpts struct {
+		// Restart removes all migrated data and checkpoints first
+		Restart bool
+		// Workers is the number of doc batches written at once
+		Workers int
+		// BatchSize is the number of docs written per transaction
+		BatchSize int
+		// Progress gets the throughput and ETA of the stages
+		Progress io.Writer
+		// Labels merges label names which only differ in white space,
+		// case or unicode form or are aliases
+		Labels LabelNormalizer
 	}
 
 	DocInfos struct {
@@ -85,245 +96,310 @@ type (
 //	5.2) Create all doc numbers
 //	5.3) Create all account data
 // 3) Create all accounting datas
-func Migrate() error {
-	sqlDB := common.InitMySQL()
+//
+// The progress of each stage is saved in the checkpoint table, a second
+// run continues after the last migrated object. Restart removes all
+// migrated data first.
+func Migrate(opts MigrateOpts) (Result, error) {
+	result := NewResult()
+
+	sqlDB, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
 	docs.AddTables(sqlDB)
 	labels.AddTables(sqlDB)
 	accountingData.AddTables(sqlDB)
 
-	err := sqlDB.CreateTablesIfNotExists()
+	err = sqlDB.CreateTablesIfNotExists()
 	if err != nil {
-		return err
+		return result, err
 	}
 
-	mgoSpecs := ReadMongoDBSpecs()
-	mgoSession, err := mgo.Dial(mgoSpecs.String())
+	err = CreateCtrlTables(sqlDB)
 	if err != nil {
-		return err
+		return result, err
 	}
-	mgoDB := mgoSession.DB(mgoSpecs.DBName)
 
-	err = MigrateLabels(sqlDB, mgoDB)
-	if err != nil {
-		return err
+	if opts.Restart {
+		err := clearMigration(sqlDB)
+		if err != nil {
+			return result, err
+		}
 	}
 
-	err = MigrateDocs(sqlDB, mgoDB)
+	mgoSession, mgoSpecs, err := dialMongoDB()
 	if err != nil {
-		return err
+		return result, err
 	}
+	defer mgoSession.Close()
+	mgoDB := mgoSession.DB(mgoSpecs.DBName)
 
-	err = MigrateAccountingData(sqlDB, mgoDB)
-	if err != nil {
-		return err
-	}
+	stages := []struct {
+		Name string
+		Run  func(*gorp.DbMap, *mgo.Database, MigrateOpts) error
+	}{
+		{StageLabels, MigrateLabels},
+		{StageDocs, MigrateDocs},
+		{StageAccountingData, MigrateAccountingData},
+	}
+	// committed is set once a stage or checkpoint wrote rows, a failure
+	// after that leaves a partial migration
+	committed := false
+	for _, stage := range stages {
+		cp, err := readCheckpoint(sqlDB, stage.Name)
+		if err != nil {
+			return result, err
+		}
+		if cp.Done {
+			log.Printf("Skip stage %v, already done", stage.Name)
+			result.Add("stages_skipped", 1)
+			committed = true
+			continue
+		}
 
-	return nil
-}
+		err = stage.Run(sqlDB, mgoDB, opts)
+		if err != nil {
+			kind := KindOf(err)
+			err = fmt.Errorf("Stage %v: %v", stage.Name, err)
+			last, cpErr := readCheckpoint(sqlDB, stage.Name)
+			if committed || cp.LastID != "" || (cpErr == nil && last.LastID != cp.LastID) {
+				return result, NewError(KindPartialImport, err)
+			}
+			return result, NewError(kind, err)
+		}
+		committed = true
 
-func MigrateDocs(sqlDB *gorp.DbMap, mgoDB *mgo.Database) error {
-	ll := []labels.Label{}
-	q := fmt.Sprintf("SELECT * FROM %v", labels.LabelsTable)
-	_, err := sqlDB.Select(&ll, q)
+		cp, err = readCheckpoint(sqlDB, stage.Name)
+		if err != nil {
+			return result, err
+		}
+		cp.Done = true
+		err = saveCheckpoint(sqlDB, cp)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	err = countTables(sqlDB, &result, map[string]string{
+		"labels":          labels.LabelsTable,
+		"docs":            docs.DocsTable,
+		"accounting_data": accountingData.AccountingDataTable,
+	})
 	if err != nil {
-		return err
+		return result, err
 	}
-	lMap := NewLabelMap(&ll)
 
-	docsColl := mgoDB.C(DocsColl)
-	docsIter := docsColl.Find(bson.M{}).Iter()
-	mDoc := &Doc{}
-	for docsIter.Next(mDoc) {
-		err := migrateDoc(sqlDB, mDoc, lMap)
+	return result, nil
+}
+
+// countTables adds the number of rows of each table to the result.
+func countTables(sqlDB *gorp.DbMap, result *Result, tables map[string]string) error {
+	for key, table := range tables {
+		n, err := sqlDB.SelectInt(fmt.Sprintf("SELECT COUNT(*) FROM %v", table))
 		if err != nil {
 			return err
 		}
-	}
-	if err := docsIter.Close(); err != nil {
-		return err
+		result.Add(key, int(n))
 	}
 
 	return nil
 }
 
-func migrateDoc(sqlDB *gorp.DbMap, mDoc *Doc, lMap map[string]int64) error {
-
-	doc := docs.Doc{
-		Name:          mDoc.Name,
-		Barcode:       mDoc.Barcode,
-		Note:          string(mDoc.Note),
-		DateOfScan:    mDoc.Infos.DateOfScan,
-		DateOfReceipt: mDoc.Infos.DateOfReceipt,
+// MigrateLabels creates a label for every name used by the docs. Names
+// which opts.Labels merges create one label named like the first of
+// them.
+func MigrateLabels(sqlDB *gorp.DbMap, mgoDB *mgo.Database, opts MigrateOpts) error {
+	l, err := ReadAllLabels(mgoDB)
+	if err != nil {
+		return err
 	}
+	RemoveDuplicates(&l)
 
-	err := sqlDB.Insert(&doc)
+	// Labels of an earlier run already exist
+	existing := []labels.Label{}
+	q := fmt.Sprintf("SELECT * FROM %v", labels.LabelsTable)
+	_, err = sqlDB.Select(&existing, q)
 	if err != nil {
 		return err
 	}
+	lMap := opts.Labels.labelMap(existing)
 
-	// Create doc numbers in sql db
-	docNumbers := []interface{}{}
-	for _, dn := range mDoc.AccountData.DocNumbers {
-		docNumbers = append(docNumbers, docs.DocNumber{DocID: doc.ID, Number: dn})
-	}
-	fields := "(doc_id,number)"
-	fun := func(v interface{}) string {
-		d, _ := v.(docs.DocNumber)
-		return fmt.Sprintf("(%v, '%v')", d.DocID, d.Number)
+	ll := []labels.Label{}
+	for _, name := range l {
+		k := opts.Labels.LabelKey(name)
+		if _, ok := lMap[k]; !ok {
+			lMap[k] = 0
+			ll = append(ll, labels.Label{Name: opts.Labels.Name(name)})
+		}
 	}
-	err = BatchInsert(sqlDB, fields, docNumbers, docs.DocNumbersTable, fun)
+
+	return NewBulkWriter(sqlDB, nil, BulkInsert).SetKeys(true, "ID").Write(ll)
+}
+
+// MigrateAccountingData copies the accounting data in transactions of
+// accBatchSize records, each saves the checkpoint of the stage and the
+// legacy ids of its records.
+func MigrateAccountingData(sqlDB *gorp.DbMap, mgoDB *mgo.Database, opts MigrateOpts) error {
+	cp, err := readCheckpoint(sqlDB, StageAccountingData)
 	if err != nil {
 		return err
 	}
 
-	// Create account data in sql db
-	accountData := docs.DocAccountData{
-		DocID:         doc.ID,
-		AccountNumber: mDoc.AccountData.AccNumber,
-		PeriodFrom:    mDoc.AccountData.DocPeriod.From,
-		PeriodTo:      mDoc.AccountData.DocPeriod.To,
-	}
-	err = sqlDB.Insert(&accountData)
+	query := mgoDB.C(AccountingDataColl).Find(cp.after()).Sort("_id")
+	total, err := query.Count()
 	if err != nil {
 		return err
 	}
+	prog := newProgress(opts.Progress, StageAccountingData, total)
+
+	iter := query.Batch(accBatchSize).Iter()
 
-	// Join labels with doc
-	docsLabels := []interface{}{}
-	for _, v := range mDoc.Labels {
-		id, ok := lMap[v]
-		if !ok {
-			msg := fmt.Sprintf("Missing label %v", v)
-			return errors.New(msg)
+	batch := []AccProcess{}
+	a := AccProcess{}
+	for iter.Next(&a) {
+		batch = append(batch, a)
+		a = AccProcess{}
+		if len(batch) < accBatchSize {
+			continue
 		}
 
-		docsLabels = append(docsLabels, docs.DocsLabels{
-			DocID:   doc.ID,
-			LabelID: id,
-		})
+		err := migrateAccountingDataTx(sqlDB, batch, &cp)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+		prog.Add(len(batch))
+		batch = batch[:0]
 	}
-	fields = "(doc_id,label_id)"
-	fun = func(v interface{}) string {
-		d, _ := v.(docs.DocsLabels)
-		return fmt.Sprintf("(%v, %v)", d.DocID, d.LabelID)
+	if err := iter.Close(); err != nil {
+		return err
 	}
-	err = BatchInsert(sqlDB, fields, docsLabels, docs.DocsLabelsTable, fun)
+
+	err = migrateAccountingDataTx(sqlDB, batch, &cp)
 	if err != nil {
 		return err
 	}
+	prog.Add(len(batch))
 
 	return nil
 }
 
-func BatchInsert(sqlDB *gorp.DbMap, fields string, data []interface{}, table string, valueSta func(interface{}) string) error {
-	if len(data) == 0 {
+func migrateAccountingDataTx(sqlDB *gorp.DbMap, d []AccProcess, cp *Checkpoint) error {
+	if len(d) == 0 {
 		return nil
 	}
 
-	q := fmt.Sprintf("INSERT INTO %v %v VALUES", table, fields)
-	iData := bytes.NewBufferString(valueSta(data[0]))
-	size := len(q) + iData.Len()
-	count := 1
-	for x := 1; x < len(data); x++ {
-		d := fmt.Sprintf(",%v", valueSta(data[x]))
-		size += len(d)
-
-		// When the insert query is bigger then 1Mbyte write it to db
-		if size > 1000000 {
-			e := fmt.Sprintf("%v %v", q, iData.String())
-			log.Println(e)
-			_, err := sqlDB.Exec(e)
-			if err != nil {
-				return err
-			}
-
-			iData = bytes.NewBufferString(valueSta(data[x]))
-			size = len(q)
-			count++
-			continue
-		}
-
-		iData.WriteString(d)
-		count++
-
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return err
 	}
 
-	if iData.Len() > 0 {
-		e := fmt.Sprintf("%v %v", q, iData.String())
-		log.Println(e)
-		_, err := sqlDB.Exec(e)
-		if err != nil {
-			return err
+	next := *cp
+	next.LastID = d[len(d)-1].ID.Hex()
+	err = writeAccountingData(sqlDB, tx, d)
+	if err == nil {
+		err = saveCheckpoint(tx, next)
+	}
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
 		}
+		return err
 	}
 
-	if count != len(data) {
-		msg := fmt.Sprintf("Expect %v data was %v - %v", len(data), count, data)
-		return errors.New(msg)
+	err = tx.Commit()
+	if err != nil {
+		return err
 	}
+	*cp = next
 
 	return nil
 }
 
-func MigrateLabels(sqlDB *gorp.DbMap, mgoDB *mgo.Database) error {
-	l, err := ReadAllLabels(mgoDB)
+// writeAccountingData inserts the records with multi row statements
+// and saves their ids in the legacy ids table. Records with a legacy id
+// are skipped.
+func writeAccountingData(sqlDB *gorp.DbMap, exec gorp.SqlExecutor, d []AccProcess) error {
+	ids := []string{}
+	for _, a := range d {
+		ids = append(ids, a.ID.Hex())
+	}
+	migrated, err := readLegacyIDs(exec, StageAccountingData, ids)
 	if err != nil {
 		return err
 	}
-	RemoveDuplicates(&l)
 
-	fields := "(name)"
-	fun := func(v interface{}) string {
-		label, _ := v.(string)
-		return fmt.Sprintf("('%v')", label)
+	mongoIDs := []string{}
+	rows := []accountingData.AccountingData{}
+	for _, a := range d {
+		if _, ok := migrated[a.ID.Hex()]; ok {
+			continue
+		}
+
+		mongoIDs = append(mongoIDs, a.ID.Hex())
+		rows = append(rows, accountingData.AccountingData{
+			DocDate:          a.DocDate,
+			DateOfEntry:      a.DateOfEntry,
+			DocNumberRange:   a.DocNumberRange,
+			DocNumber:        a.DocNumber,
+			PostingText:      a.PostingText,
+			AmountPosted:     a.AmountPosted,
+			DebitAccount:     a.DebitAcc,
+			CreditAccount:    a.CreditAcc,
+			TaxCode:          a.TaxCode,
+			CostUnit1:        a.CostUnit1,
+			CostUnit2:        a.CostUnit2,
+			AmountPostedEuro: a.AmountPostedEuro,
+			Currency:         a.Currency,
+		})
+	}
+	if len(rows) == 0 {
+		return nil
 	}
 
-	return BatchInsert(sqlDB, fields, IfaceSlice(l), labels.LabelsTable, fun)
-}
+	step, err := exec.SelectInt("SELECT @@auto_increment_increment")
+	if err != nil {
+		return err
+	}
 
-func MigrateAccountingData(sqlDB *gorp.DbMap, mgoDB *mgo.Database) error {
-	c := mgoDB.C(AccountingDataColl)
-	d := []AccProcess{}
-	err := c.Find(bson.M{}).All(&d)
+	w := NewBulkWriter(sqlDB, exec, BulkInsert).SetKeys(true, "ID")
+	stmts, err := w.write(rows)
 	if err != nil {
 		return err
 	}
+	mysqlIDs, err := insertedIDs(stmts, len(rows), step)
+	if err != nil {
+		return err
+	}
+
+	legacy := []LegacyID{}
+	for i, id := range mongoIDs {
+		legacy = append(legacy, LegacyID{
+			Kind:    StageAccountingData,
+			MongoID: id,
+			MySQLID: mysqlIDs[i],
+		})
+	}
 
-	fun := func(v interface{}) string {
-		a, _ := v.(AccProcess)
-		return fmt.Sprintf("('%v','%v','%v','%v','%v',%v,%v,%v,%v,'%v','%v',%v,'%v')",
-			a.DocDate,
-			a.DateOfEntry,
-			a.DocNumberRange,
-			a.DocNumber,
-			a.PostingText,
-			a.AmountPosted,
-			a.DebitAcc,
-			a.CreditAcc,
-			a.TaxCode,
-			a.CostUnit1,
-			a.CostUnit2,
-			a.AmountPostedEuro,
-			a.Currency,
-		)
-	}
-	fields := "(doc_date,date_of_entry,doc_number_range,doc_number,posting_text,amount_posted,debit_account,credit_account,tax_code,cost_unit1,cost_unit2,amount_posted_euro,currency)"
-
-	return BatchInsert(sqlDB, fields, IfaceSlice(d), accountingData.AccountingDataTable, fun)
+	return saveLegacyIDs(exec, legacy)
 }
 
+// ReadAllLabels returns the labels of all docs, the docs are streamed
+// with only their labels.
 func ReadAllLabels(db *mgo.Database) ([]string, error) {
 	c := db.C(DocsColl)
-
-	docs := []Doc{}
-	err := c.Find(bson.M{}).All(&docs)
-	if err != nil {
-		return []string{}, err
-	}
+	iter := c.Find(bson.M{}).Select(bson.M{"labels": 1}).Iter()
 
 	r := []string{}
-	for _, d := range docs {
+	d := Doc{}
+	for iter.Next(&d) {
 		r = append(r, d.Labels...)
+		d = Doc{}
+	}
+	if err := iter.Close(); err != nil {
+		return []string{}, err
 	}
 
 	return r, nil
@@ -351,25 +427,11 @@ func NewLabelMap(l *[]labels.Label) map[string]int64 {
 	return m
 }
 
-func ReadMongoDBSpecs() MongoDBSpecs {
-	specs := MongoDBSpecs{}
-	err := envconfig.Process("", &specs)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return specs
-}
-
-func (s MongoDBSpecs) String() string {
-	return fmt.Sprintf("mongodb://%v/%v", s.Host, s.DBName)
-}
-
 // Make []"any type" to []interface{}
-func IfaceSlice(slice interface{}) []interface{} {
+func IfaceSlice(slice interface{}) ([]interface{}, error) {
 	s := reflect.ValueOf(slice)
 	if s.Kind() != reflect.Slice {
-		log.Fatal("InterfaceSlice() given a non-slice type")
+		return nil, ErrNoSlice
 	}
 
 	ret := make([]interface{}, s.Len())
@@ -378,5 +440,5 @@ func IfaceSlice(slice interface{}) []interface{} {
 		ret[i] = s.Index(i).Interface()
 	}
 
-	return ret
+	return ret, nil
 }
@@ -2,12 +2,15 @@ package cmds
 
 import (
 	"fmt"
+	"os"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/gorp.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"github.com/tochti/docMa-handler/accountingData"
 	"github.com/tochti/docMa-handler/common"
@@ -18,12 +21,46 @@ import (
 
 func Test_ReadMonogDBSpecs(t *testing.T) {
 	setenv()
-	s := ReadMongoDBSpecs()
+	s, err := ReadMongoDBSpecs()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expect := "mongodb://127.0.0.1/testing"
 	if s.String() != expect {
 		t.Fatalf("Expect %v was %v", expect, s.String())
 	}
+
+	if s.DialTimeout != 10*time.Second {
+		t.Fatalf("Expect %v was %v", 10*time.Second, s.DialTimeout)
+	}
+
+	os.Setenv("MONGODB_HOST", "")
+	os.Setenv("MONGODB_SEEDS", "db1:27017,db2:27017")
+	os.Setenv("MONGODB_REPLICA_SET", "rs0")
+	os.Setenv("MONGODB_USER", "tochti")
+	s, err = ReadMongoDBSpecs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect = "mongodb://tochti@db1:27017,db2:27017/testing?replicaSet=rs0"
+	if s.String() != expect {
+		t.Fatalf("Expect %v was %v", expect, s.String())
+	}
+
+	os.Setenv("MONGODB_SEEDS", "")
+	_, err = ReadMongoDBSpecs()
+	if KindOf(err) != KindConfig {
+		t.Fatalf("Expect %v was %v", KindConfig, err)
+	}
+
+	os.Setenv("MONGODB_HOST", "127.0.0.1")
+	os.Setenv("MONGODB_DIAL_TIMEOUT", "soon")
+	_, err = ReadMongoDBSpecs()
+	if KindOf(err) != KindConfig {
+		t.Fatalf("Expect %v was %v", KindConfig, err)
+	}
 }
 
 func Test_ReadAllLabels(t *testing.T) {
@@ -133,7 +170,7 @@ func Test_MigrateDocs(t *testing.T) {
 	docsColl := mgoDB.C(DocsColl)
 	err = docsColl.Insert(d1, d2)
 
-	err = MigrateDocs(sqlDB, mgoDB)
+	err = MigrateDocs(sqlDB, mgoDB, MigrateOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -243,7 +280,7 @@ func Test_MigrateLabels(t *testing.T) {
 	docsColl := mgoDB.C(DocsColl)
 	err := docsColl.Insert(d1, d2)
 
-	err = MigrateLabels(sqlDB, mgoDB)
+	err = MigrateLabels(sqlDB, mgoDB, MigrateOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -309,7 +346,7 @@ func Test_MigrateLabels_ManyLabels(t *testing.T) {
 	docsColl := mgoDB.C(DocsColl)
 	err := docsColl.Insert(d1)
 
-	err = MigrateLabels(sqlDB, mgoDB)
+	err = MigrateLabels(sqlDB, mgoDB, MigrateOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -324,6 +361,41 @@ func Test_MigrateLabels_ManyLabels(t *testing.T) {
 
 }
 
+func Test_MigrateLabels_Quotes(t *testing.T) {
+	sqlDB, mgoDB := initDB(t)
+	defer sqlDB.Db.Close()
+	defer mgoDB.Session.Close()
+
+	d1 := Doc{
+		Name:   "Name-1",
+		Labels: []string{"Rechnung's", `"; DROP TABLE labels; --`},
+	}
+
+	docsColl := mgoDB.C(DocsColl)
+	err := docsColl.Insert(d1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateLabels(sqlDB, mgoDB, MigrateOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rLabels := []labels.Label{}
+	q := fmt.Sprintf("SELECT * FROM %v ORDER BY id", labels.LabelsTable)
+	_, err = sqlDB.Select(&rLabels, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rLabels) != 2 ||
+		rLabels[0].Name != d1.Labels[0] ||
+		rLabels[1].Name != d1.Labels[1] {
+		t.Fatalf("Expect %v was %v", d1.Labels, rLabels)
+	}
+}
+
 func Test_MigrateAccountingData(t *testing.T) {
 	sqlDB, mgoDB := initDB(t)
 
@@ -350,7 +422,7 @@ func Test_MigrateAccountingData(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = MigrateAccountingData(sqlDB, mgoDB)
+	err = MigrateAccountingData(sqlDB, mgoDB, MigrateOpts{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -399,8 +471,130 @@ func Test_MigrateAccountingData(t *testing.T) {
 
 }
 
+func Test_MigrateDocs_Resume(t *testing.T) {
+	sqlDB, mgoDB := initDB(t)
+	defer sqlDB.Db.Close()
+	defer mgoDB.Session.Close()
+
+	id1 := bson.NewObjectId()
+	id2 := bson.NewObjectId()
+	err := mgoDB.C(DocsColl).Insert(
+		Doc{ID: id1, Name: "Name-1", Labels: []string{}},
+		Doc{ID: id2, Name: "Name-2", Labels: []string{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first doc was migrated before the last run failed
+	err = saveCheckpoint(sqlDB, Checkpoint{Stage: StageDocs, LastID: id1.Hex()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = MigrateDocs(sqlDB, mgoDB, MigrateOpts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rDocs := []docs.Doc{}
+	q := fmt.Sprintf("SELECT * FROM %v", docs.DocsTable)
+	_, err = sqlDB.Select(&rDocs, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rDocs) != 1 || rDocs[0].Name != "Name-2" {
+		t.Fatalf("Expect %v was %v", "Name-2", rDocs)
+	}
+
+	cp, err := readCheckpoint(sqlDB, StageDocs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.LastID != id2.Hex() {
+		t.Fatalf("Expect %v was %v", id2.Hex(), cp.LastID)
+	}
+
+	ids, err := readLegacyIDs(sqlDB, StageDocs, []string{id1.Hex(), id2.Hex()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]int64{id2.Hex(): rDocs[0].ID}
+	if !reflect.DeepEqual(expect, ids) {
+		t.Fatalf("Expect %v was %v", expect, ids)
+	}
+}
+
+func Test_Migrate_Restart(t *testing.T) {
+	sqlDB, mgoDB := initDB(t)
+	defer sqlDB.Db.Close()
+	defer mgoDB.Session.Close()
+
+	err := mgoDB.C(DocsColl).Insert(
+		Doc{ID: bson.NewObjectId(), Name: "Name-1", Labels: []string{}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Migrate(MigrateOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A doc of an import after the migration
+	imported := docs.Doc{Name: "Imported"}
+	err = sqlDB.Insert(&imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlDB.Insert(&docs.DocNumber{DocID: imported.ID, Number: "DN1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Migrate(MigrateOpts{Restart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	q := fmt.Sprintf("SELECT name FROM %v ORDER BY name", docs.DocsTable)
+	_, err = sqlDB.Select(&names, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"Imported", "Name-1"}
+	if !reflect.DeepEqual(expect, names) {
+		t.Fatalf("Expect %v was %v", expect, names)
+	}
+
+	q = fmt.Sprintf("SELECT COUNT(*) FROM %v WHERE doc_id=?", docs.DocNumbersTable)
+	n, err := sqlDB.SelectInt(q, imported.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expect %v was %v", 1, n)
+	}
+
+	q = fmt.Sprintf("SELECT COUNT(*) FROM %v", LegacyIDsTable)
+	n, err = sqlDB.SelectInt(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("Expect %v was %v", 1, n)
+	}
+}
+
 func Test_IfaceSlice(t *testing.T) {
-	result := IfaceSlice([]string{"a", "b"})
+	result, err := IfaceSlice([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	expect := []interface{}{
 		"a",
@@ -412,6 +606,11 @@ func Test_IfaceSlice(t *testing.T) {
 			t.Fatalf("Expect %v was %v", s, result[i])
 		}
 	}
+
+	_, err = IfaceSlice("a")
+	if err != ErrNoSlice {
+		t.Fatalf("Expect %v was %v", ErrNoSlice, err)
+	}
 }
 
 func initDB(t *testing.T) (*gorp.DbMap, *mgo.Database) {
@@ -427,13 +626,22 @@ func initDB(t *testing.T) (*gorp.DbMap, *mgo.Database) {
 		t.Fatal(err)
 	}
 
+	err = DropCtrlTables(dbMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	err = dbMap.CreateTablesIfNotExists()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	mgoSpecs := ReadMongoDBSpecs()
-	mgoSession, err := mgo.Dial(mgoSpecs.String())
+	err = CreateCtrlTables(dbMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mgoSession, _, err := dialMongoDB()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,156 @@
+package cmds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/mgo.v2"
+)
+
+type (
+	// MongoDBSpecs configures the MongoDB connection. Host can be a
+	// comma separated list, Seeds is an alternative for replica sets.
+	// A CAFile enables TLS too.
+	MongoDBSpecs struct {
+		Host          string        `envconfig:"MONGODB_HOST"`
+		Seeds         []string      `envconfig:"MONGODB_SEEDS"`
+		ReplicaSet    string        `envconfig:"MONGODB_REPLICA_SET"`
+		DBName        string        `envconfig:"MONGODB_DB_NAME"`
+		User          string        `envconfig:"MONGODB_USER"`
+		Password      string        `envconfig:"MONGODB_PASSWORD"`
+		AuthDB        string        `envconfig:"MONGODB_AUTH_DB"`
+		TLS           bool          `envconfig:"MONGODB_TLS"`
+		CAFile        string        `envconfig:"MONGODB_CA_FILE"`
+		DialTimeout   time.Duration `envconfig:"MONGODB_DIAL_TIMEOUT" default:"10s"`
+		SocketTimeout time.Duration `envconfig:"MONGODB_SOCKET_TIMEOUT" default:"1m"`
+	}
+)
+
+// ReadMongoDBSpecs reads the specs from the environment and checks
+// them. Errors are of KindConfig.
+func ReadMongoDBSpecs() (MongoDBSpecs, error) {
+	specs := MongoDBSpecs{}
+	err := envconfig.Process("", &specs)
+	if err != nil {
+		return specs, NewError(KindConfig, err)
+	}
+
+	err = specs.Validate()
+	if err != nil {
+		return specs, NewError(KindConfig, err)
+	}
+
+	return specs, nil
+}
+
+func (s MongoDBSpecs) Validate() error {
+	if len(s.Addrs()) == 0 {
+		return errors.New("MONGODB_HOST or MONGODB_SEEDS is required")
+	}
+	if s.DBName == "" {
+		return errors.New("MONGODB_DB_NAME is required")
+	}
+	if s.User == "" && (s.Password != "" || s.AuthDB != "") {
+		return errors.New("MONGODB_PASSWORD and MONGODB_AUTH_DB need MONGODB_USER")
+	}
+	if s.DialTimeout <= 0 || s.SocketTimeout <= 0 {
+		return errors.New("MONGODB_DIAL_TIMEOUT and MONGODB_SOCKET_TIMEOUT have to be positive")
+	}
+
+	return nil
+}
+
+// Addrs returns the servers to connect to.
+func (s MongoDBSpecs) Addrs() []string {
+	r := []string{}
+	for _, a := range append(strings.Split(s.Host, ","), s.Seeds...) {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			r = append(r, a)
+		}
+	}
+
+	return r
+}
+
+// DialInfo returns the connection settings, the CA file is read here.
+func (s MongoDBSpecs) DialInfo() (*mgo.DialInfo, error) {
+	info := &mgo.DialInfo{
+		Addrs:          s.Addrs(),
+		Database:       s.DBName,
+		ReplicaSetName: s.ReplicaSet,
+		Username:       s.User,
+		Password:       s.Password,
+		Source:         s.AuthDB,
+		Timeout:        s.DialTimeout,
+	}
+
+	if !s.TLS && s.CAFile == "" {
+		return info, nil
+	}
+
+	conf := &tls.Config{}
+	if s.CAFile != "" {
+		b, err := ioutil.ReadFile(s.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates in %v", s.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: s.DialTimeout}
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.DialWithDialer(dialer, "tcp", addr.String(), conf)
+	}
+
+	return info, nil
+}
+
+// String returns the connection without the password.
+func (s MongoDBSpecs) String() string {
+	user := ""
+	if s.User != "" {
+		user = s.User + "@"
+	}
+
+	r := fmt.Sprintf("mongodb://%v%v/%v", user, strings.Join(s.Addrs(), ","), s.DBName)
+	if s.ReplicaSet != "" {
+		r += "?replicaSet=" + s.ReplicaSet
+	}
+
+	return r
+}
+
+// dialMongoDB connects to the MongoDB of the environment. The caller
+// has to close the session.
+func dialMongoDB() (*mgo.Session, MongoDBSpecs, error) {
+	specs, err := ReadMongoDBSpecs()
+	if err != nil {
+		return nil, specs, err
+	}
+
+	info, err := specs.DialInfo()
+	if err != nil {
+		return nil, specs, NewError(KindConfig, err)
+	}
+
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, specs, NewError(KindDBConnection, fmt.Errorf("%v: %v", specs, err))
+	}
+	session.SetSocketTimeout(specs.SocketTimeout)
+
+	return session, specs, nil
+}
@@ -0,0 +1,70 @@
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+type (
+	// progress prints how many of total items are done, the throughput
+	// and the estimated time left. Lines are written at most once per
+	// interval and when all items are done.
+	progress struct {
+		w        io.Writer
+		name     string
+		total    int
+		done     int
+		start    time.Time
+		last     time.Time
+		interval time.Duration
+	}
+)
+
+func newProgress(w io.Writer, name string, total int) *progress {
+	now := time.Now()
+	return &progress{
+		w:        w,
+		name:     name,
+		total:    total,
+		start:    now,
+		last:     now,
+		interval: time.Second,
+	}
+}
+
+func (p *progress) Add(n int) {
+	p.done += n
+	if p.w == nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(p.last) < p.interval && p.done < p.total {
+		return
+	}
+	p.last = now
+
+	fmt.Fprintln(p.w, p.line(now))
+}
+
+func (p *progress) line(now time.Time) string {
+	elapsed := now.Sub(p.start)
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed.Seconds()
+	}
+
+	if p.total <= 0 {
+		return fmt.Sprintf("%v: %v, %.1f/s", p.name, p.done, rate)
+	}
+
+	eta := "?"
+	if rate > 0 {
+		left := time.Duration(float64(p.total-p.done) / rate * float64(time.Second))
+		eta = left.Truncate(time.Second).String()
+	}
+
+	return fmt.Sprintf("%v: %v/%v (%.1f%%), %.1f/s, ETA %v",
+		p.name, p.done, p.total, float64(p.done)*100/float64(p.total), rate, eta)
+}
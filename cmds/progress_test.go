@@ -0,0 +1,24 @@
+package cmds
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Progress_Line(t *testing.T) {
+	p := newProgress(nil, "docs", 300)
+	p.Add(100)
+
+	r := p.line(p.start.Add(10 * time.Second))
+	expect := "docs: 100/300 (33.3%), 10.0/s, ETA 20s"
+	if r != expect {
+		t.Fatalf("Expect %v was %v", expect, r)
+	}
+
+	p.total = 0
+	r = p.line(p.start.Add(10 * time.Second))
+	expect = "docs: 100, 10.0/s"
+	if r != expect {
+		t.Fatalf("Expect %v was %v", expect, r)
+	}
+}
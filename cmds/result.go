@@ -0,0 +1,30 @@
+package cmds
+
+import "fmt"
+
+type (
+	// Result summarizes what a command did. Counts are keyed by the
+	// thing counted, e.g. "docs" or "labels". Errors collects problems
+	// which did not stop the command. Details holds a command specific
+	// report, e.g. the plan of a dry run.
+	Result struct {
+		Counts  map[string]int `json:"counts"`
+		Errors  []string       `json:"errors"`
+		Details interface{}    `json:"details,omitempty"`
+	}
+)
+
+func NewResult() Result {
+	return Result{
+		Counts: map[string]int{},
+		Errors: []string{},
+	}
+}
+
+func (r *Result) Add(key string, n int) {
+	r.Counts[key] += n
+}
+
+func (r *Result) AddError(format string, v ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,298 @@
+package cmds
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+const (
+	// stagingJoin matches the staged transactions s with the keys k of
+	// the stored ones
+	stagingJoin = "s.natural_key=k.natural_key AND s.occurrence=k.occurrence"
+)
+
+type (
+	// stagedTx is a transaction in the staging table, ID is the index
+	// of Row plus one.
+	stagedTx struct {
+		ID  int64
+		Row txsRow
+	}
+)
+
+// SyncAccountingTxs makes the stored transactions equal to txsFile. The
+// export is loaded into a staging table and compared with the stored
+// transactions by their keys. Inserts, updates and deletes are applied
+// in one transaction, so readers never see a half synced table and
+// unchanged transactions keep their id.
+func SyncAccountingTxs(txsFile string, opts ImportTxsOpts) (Result, error) {
+	result := NewResult()
+
+	if opts.OnInvalid != TxsAbort {
+		err := errors.New("Sync needs all transactions of the export, invalid transactions have to abort")
+		return result, NewError(KindConfig, err)
+	}
+
+	rows, err := readValidTxs(txsFile, opts, &result)
+	if err != nil {
+		return result, err
+	}
+	keyTxs(rows)
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
+	accountingData.AddTables(db)
+
+	err = CreateCtrlTables(db)
+	if err != nil {
+		return result, err
+	}
+
+	counts, err := syncTxs(db, rows, opts)
+	for k, n := range counts {
+		result.Add(k, n)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// syncTxs stages the keyed rows in a staging table of its own and
+// applies them in one transaction.
+func syncTxs(db *gorp.DbMap, rows []txsRow, opts ImportTxsOpts) (map[string]int, error) {
+	counts := map[string]int{}
+
+	cols, err := txsColumns(db)
+	if err != nil {
+		return counts, err
+	}
+
+	staging, err := txsStagingTable()
+	if err != nil {
+		return counts, err
+	}
+
+	err = createTxsStaging(db, staging)
+	defer func() {
+		_, err := db.Exec("DROP TABLE IF EXISTS " + staging)
+		if err != nil {
+			log.Println(err)
+		}
+	}()
+	if err != nil {
+		return counts, err
+	}
+
+	err = stageTxs(db, staging, cols, rows, opts.BatchSize)
+	if err != nil {
+		return counts, err
+	}
+	counts["staged"] = len(rows)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return counts, err
+	}
+
+	applied, err := applyTxsSync(db, tx, staging, cols, rows, opts)
+	if err != nil {
+		rErr := tx.Rollback()
+		if rErr != nil {
+			log.Println(rErr)
+		}
+		return counts, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return counts, err
+	}
+
+	for k, n := range applied {
+		counts[k] = n
+	}
+
+	return counts, nil
+}
+
+// txsStagingTable returns a new staging table name, so concurrent syncs
+// do not share a table.
+func txsStagingTable() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return TxsStagingPrefix + hex.EncodeToString(b), nil
+}
+
+// txsColumns returns the columns of the accounting data table without
+// the id.
+func txsColumns(db *gorp.DbMap) ([]bulkColumn, error) {
+	t := reflect.TypeOf(accountingData.AccountingData{})
+	table, err := db.TableFor(t, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return bulkColumns(t, table, true, "ID")
+}
+
+// createTxsStaging creates the empty staging table with the columns of
+// the accounting data table and the keys.
+func createTxsStaging(db gorp.SqlExecutor, staging string) error {
+	queries := []string{
+		fmt.Sprintf("CREATE TABLE %v LIKE %v", staging, accountingData.AccountingDataTable),
+		fmt.Sprintf(`
+		ALTER TABLE %v
+			ADD COLUMN natural_key CHAR(64) NOT NULL,
+			ADD COLUMN occurrence INT NOT NULL,
+			ADD COLUMN row_hash CHAR(64) NOT NULL,
+			ADD INDEX (natural_key, occurrence)`,
+			staging),
+	}
+	for _, q := range queries {
+		_, err := db.Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stageTxs writes rows with their keys to the staging table, at most
+// batchSize rows per statement.
+func stageTxs(db gorp.SqlExecutor, staging string, cols []bulkColumn, rows []txsRow, batchSize int) error {
+	fields := []string{"id"}
+	for _, c := range cols {
+		fields = append(fields, c.Name)
+	}
+	fields = append(fields, "natural_key", "occurrence", "row_hash")
+
+	data := make([]interface{}, len(rows))
+	for i, r := range rows {
+		data[i] = stagedTx{ID: int64(i + 1), Row: r}
+	}
+
+	values := func(i interface{}) []interface{} {
+		s := i.(stagedTx)
+		v := reflect.ValueOf(s.Row.Tx)
+		r := []interface{}{s.ID}
+		for _, c := range cols {
+			r = append(r, v.FieldByName(c.Field).Interface())
+		}
+		return append(r, s.Row.Key.NaturalKey, s.Row.Key.Occurrence, s.Row.Key.RowHash)
+	}
+
+	return batchInsert(db, "INSERT", "", fields, data, staging, values, Chunker{MaxRows: batchSize})
+}
+
+// applyTxsSync deletes the stored transactions which are not staged,
+// updates the changed ones and inserts the new ones. rows are the
+// staged transactions, exec is a transaction of dbMap.
+func applyTxsSync(dbMap *gorp.DbMap, exec gorp.SqlExecutor, staging string, cols []bulkColumn, rows []txsRow, opts ImportTxsOpts) (map[string]int, error) {
+	counts := map[string]int{}
+
+	keys, err := readTxsKeys(exec)
+	if err != nil {
+		return nil, err
+	}
+
+	counts["keyed"], err = backfillTxsKeys(exec, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	q := fmt.Sprintf(`
+		SELECT COUNT(*) FROM %v AS k
+		LEFT JOIN %v AS s ON %v
+		WHERE s.id IS NULL`,
+		TxsKeysTable, staging, stagingJoin)
+	deleted, err := exec.SelectInt(q)
+	if err != nil {
+		return nil, err
+	}
+
+	q = fmt.Sprintf(`
+		DELETE k, a FROM %v AS k
+		LEFT JOIN %v AS a ON a.id=k.accounting_data_id
+		LEFT JOIN %v AS s ON %v
+		WHERE s.id IS NULL`,
+		TxsKeysTable, accountingData.AccountingDataTable, staging, stagingJoin)
+	_, err = exec.Exec(q)
+	if err != nil {
+		return nil, err
+	}
+	counts["deleted"] = int(deleted)
+
+	q = fmt.Sprintf(`
+		SELECT COUNT(*) FROM %v AS k
+		JOIN %v AS s ON %v
+		WHERE k.row_hash<>s.row_hash`,
+		TxsKeysTable, staging, stagingJoin)
+	updated, err := exec.SelectInt(q)
+	if err != nil {
+		return nil, err
+	}
+
+	set := []string{}
+	for _, c := range cols {
+		set = append(set, fmt.Sprintf("a.%v=s.%v", c.Name, c.Name))
+	}
+	set = append(set, "k.row_hash=s.row_hash")
+	q = fmt.Sprintf(`
+		UPDATE %v AS a
+		JOIN %v AS k ON k.accounting_data_id=a.id
+		JOIN %v AS s ON %v
+		SET %v
+		WHERE k.row_hash<>s.row_hash`,
+		accountingData.AccountingDataTable, TxsKeysTable, staging, stagingJoin,
+		strings.Join(set, ", "))
+	_, err = exec.Exec(q)
+	if err != nil {
+		return nil, err
+	}
+	counts["updated"] = int(updated)
+
+	ids := []int64{}
+	q = fmt.Sprintf(`
+		SELECT s.id FROM %v AS s
+		LEFT JOIN %v AS k ON %v
+		WHERE k.accounting_data_id IS NULL
+		ORDER BY s.id`,
+		staging, TxsKeysTable, stagingJoin)
+	_, err = exec.Select(&ids, q)
+	if err != nil {
+		return nil, err
+	}
+
+	insert := []txsRow{}
+	for _, id := range ids {
+		insert = append(insert, rows[id-1])
+	}
+
+	p := newProgress(opts.Progress, "txs", len(insert))
+	err = insertTxs(dbMap, exec, insert, opts.BatchSize, p)
+	if err != nil {
+		return nil, err
+	}
+	counts["inserted"] = len(ids)
+	counts["unchanged"] = len(rows) - len(ids) - counts["updated"]
+
+	return counts, nil
+}
@@ -0,0 +1,146 @@
+package cmds
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+func Test_TxsColumns(t *testing.T) {
+	dbMap := &gorp.DbMap{Dialect: gorp.MySQLDialect{}}
+	dbMap.AddTableWithName(accountingData.AccountingData{}, accountingData.AccountingDataTable).SetKeys(true, "ID")
+
+	cols, err := txsColumns(dbMap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cols) != 13 {
+		t.Fatalf("Expect %v was %v", 13, cols)
+	}
+	for _, c := range cols {
+		if c.Name == "id" || c.Key {
+			t.Fatalf("Expect %v was %v", "no id column", c)
+		}
+	}
+	if cols[0].Name != "doc_date" || cols[0].Field != "DocDate" {
+		t.Fatalf("Expect %v was %v", "doc_date", cols[0])
+	}
+}
+
+func Test_SyncTxs(t *testing.T) {
+	db := initMySQL(t)
+
+	rows := []txsRow{}
+	for _, dn := range []string{"unchanged", "changed", "removed"} {
+		tx := validTx()
+		tx.DocNumber = dn
+		rows = append(rows, txsRow{Tx: tx})
+	}
+	_, err := importTxsTx(t, db, rows, ImportTxsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := txsIDs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := validTx()
+	unchanged.DocNumber = "unchanged"
+	changed := validTx()
+	changed.DocNumber = "changed"
+	changed.PostingText = "Changed"
+	inserted := validTx()
+	inserted.DocNumber = "inserted"
+	export := []txsRow{{Tx: unchanged}, {Tx: changed}, {Tx: inserted}}
+	keyTxs(export)
+
+	counts, err := syncTxs(db, export, ImportTxsOpts{BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]int{"staged": 3, "keyed": 0, "deleted": 1, "updated": 1, "inserted": 1, "unchanged": 1}
+	for k, n := range expect {
+		if counts[k] != n {
+			t.Fatalf("Expect %v was %v", expect, counts)
+		}
+	}
+
+	after, err := txsIDs(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 3 || after["unchanged"] != before["unchanged"] || after["changed"] != before["changed"] {
+		t.Fatalf("Expect %v was %v", before, after)
+	}
+	if _, ok := after["removed"]; ok {
+		t.Fatalf("Expect %v was %v", "removed deleted", after)
+	}
+
+	text, err := db.SelectStr("SELECT posting_text FROM accounting_data WHERE id=?", after["changed"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "Changed" {
+		t.Fatalf("Expect %v was %v", "Changed", text)
+	}
+
+	n, err := db.SelectInt(fmt.Sprintf(`
+		SELECT COUNT(*) FROM %v AS a, %v AS k
+		WHERE k.accounting_data_id=a.id`,
+		accountingData.AccountingDataTable, TxsKeysTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("Expect %v was %v", 3, n)
+	}
+
+	// The staging table is dropped
+	tables := []string{}
+	_, err = db.Select(&tables, "SHOW TABLES")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if strings.HasPrefix(table, TxsStagingPrefix) {
+			t.Fatalf("Expect %v was %v", "no staging table", table)
+		}
+	}
+}
+
+func Test_TxsStagingTable(t *testing.T) {
+	a, err := txsStagingTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := txsStagingTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a == b || !strings.HasPrefix(a, TxsStagingPrefix) {
+		t.Fatalf("Expect %v was %v", "two staging tables", []string{a, b})
+	}
+}
+
+// txsIDs returns the ids of the stored transactions by doc number.
+func txsIDs(db *gorp.DbMap) (map[string]int64, error) {
+	rows := []accountingData.AccountingData{}
+	_, err := db.Select(&rows, "SELECT * FROM "+accountingData.AccountingDataTable)
+	if err != nil {
+		return nil, err
+	}
+
+	r := map[string]int64{}
+	for _, a := range rows {
+		r[a.DocNumber] = a.ID
+	}
+
+	return r, nil
+}
@@ -0,0 +1,89 @@
+package cmds
+
+import (
+	"gopkg.in/gorp.v1"
+)
+
+const (
+	DocHashesTable          = "doc_hashes"
+	MigrateCheckpointsTable = "migrate_checkpoints"
+	LegacyIDsTable          = "legacy_ids"
+	TxsKeysTable            = "txs_keys"
+	// TxsStagingPrefix starts the name of the staging table created
+	// from the accounting data table for every sync, it is no ctrl
+	// table. Every sync gets its own table.
+	TxsStagingPrefix = "accounting_data_staging_"
+)
+
+var (
+	// ctrlTables are the tables only used by docMa-ctrl. They are
+	// created with plain SQL because they need indexes.
+	ctrlTables = map[string]string{
+		DocHashesTable: `
+		CREATE TABLE IF NOT EXISTS doc_hashes (
+			doc_id BIGINT NOT NULL PRIMARY KEY,
+			sha256 CHAR(64) NOT NULL,
+			INDEX (sha256)
+		)`,
+		MigrateCheckpointsTable: `
+		CREATE TABLE IF NOT EXISTS migrate_checkpoints (
+			stage VARCHAR(32) NOT NULL PRIMARY KEY,
+			last_id CHAR(24) NOT NULL DEFAULT '',
+			done BOOL NOT NULL DEFAULT FALSE,
+			updated_at DATETIME NOT NULL
+		)`,
+		LegacyIDsTable: `
+		CREATE TABLE IF NOT EXISTS legacy_ids (
+			kind VARCHAR(32) NOT NULL,
+			mongo_id CHAR(24) NOT NULL,
+			mysql_id BIGINT NOT NULL,
+			PRIMARY KEY (kind, mongo_id),
+			INDEX (kind, mysql_id)
+		)`,
+		TxsKeysTable: `
+		CREATE TABLE IF NOT EXISTS txs_keys (
+			accounting_data_id BIGINT NOT NULL PRIMARY KEY,
+			natural_key CHAR(64) NOT NULL,
+			occurrence INT NOT NULL,
+			row_hash CHAR(64) NOT NULL,
+			INDEX (natural_key, occurrence)
+		)`,
+	}
+)
+
+// CreateCtrlTables creates the tables of docMa-ctrl if they not exist.
+func CreateCtrlTables(db *gorp.DbMap) error {
+	for _, q := range ctrlTables {
+		_, err := db.Exec(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DropCtrlTables drops the tables of docMa-ctrl if they exist.
+func DropCtrlTables(db *gorp.DbMap) error {
+	for table := range ctrlTables {
+		_, err := db.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ctrlTableExists reports whether table exists in the current database.
+// Read only commands use it instead of creating the ctrl tables.
+func ctrlTableExists(db gorp.SqlExecutor, table string) (bool, error) {
+	n, err := db.SelectInt(`
+		SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema=DATABASE() AND table_name=?`, table)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,171 @@
+package cmds
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+type (
+	// camtReader reads the entries of CAMT.053 bank statements. A
+	// statement knows no ledger accounts, credits are booked from
+	// ContraAccount to BankAccount and debits the other way round.
+	camtReader struct {
+		data          []byte
+		dec           *xml.Decoder
+		bankAccount   int
+		contraAccount int
+		line          int
+		// offset is the input offset up to which the newlines are
+		// counted in line
+		offset int64
+	}
+
+	camtEntry struct {
+		Amt struct {
+			Value string `xml:",chardata"`
+			Ccy   string `xml:"Ccy,attr"`
+		} `xml:"Amt"`
+		CdtDbtInd    string         `xml:"CdtDbtInd"`
+		BookgDt      camtDate       `xml:"BookgDt"`
+		ValDt        camtDate       `xml:"ValDt"`
+		AcctSvcrRef  string         `xml:"AcctSvcrRef"`
+		AddtlNtryInf string         `xml:"AddtlNtryInf"`
+		TxDtls       []camtTxDetail `xml:"NtryDtls>TxDtls"`
+	}
+
+	camtTxDetail struct {
+		EndToEndID string   `xml:"Refs>EndToEndId"`
+		Ustrd      []string `xml:"RmtInf>Ustrd"`
+	}
+
+	camtDate struct {
+		Dt   string `xml:"Dt"`
+		DtTm string `xml:"DtTm"`
+	}
+)
+
+func detectCamt053(head []byte) bool {
+	return bytes.Contains(head, []byte("camt.053")) ||
+		bytes.Contains(head, []byte("BkToCstmrStmt"))
+}
+
+func openCamt053(r *bufio.Reader, opts ImportTxsOpts) (txsReader, error) {
+	if opts.BankAccount == 0 || opts.ContraAccount == 0 {
+		return nil, errors.New("CAMT.053 statements need a bank and a contra account")
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &camtReader{
+		data:          data,
+		dec:           xml.NewDecoder(bytes.NewReader(data)),
+		bankAccount:   opts.BankAccount,
+		contraAccount: opts.ContraAccount,
+		line:          1,
+	}, nil
+}
+
+func (c *camtReader) Read() (accountingData.AccountingData, error) {
+	for {
+		t, err := c.dec.Token()
+		if err != nil {
+			return accountingData.AccountingData{}, err
+		}
+
+		se, ok := t.(xml.StartElement)
+		if !ok || se.Name.Local != "Ntry" {
+			continue
+		}
+		end := c.dec.InputOffset()
+		c.line += bytes.Count(c.data[c.offset:end], []byte("\n"))
+		c.offset = end
+
+		e := camtEntry{}
+		err = c.dec.DecodeElement(&e, &se)
+		if err != nil {
+			// The rest of the document cannot be read
+			c.dec = xml.NewDecoder(bytes.NewReader(nil))
+			return accountingData.AccountingData{}, err
+		}
+
+		return c.tx(e)
+	}
+}
+
+func (c *camtReader) tx(e camtEntry) (accountingData.AccountingData, error) {
+	tx := accountingData.AccountingData{}
+
+	var fErr error
+	check := func(name string, err error) {
+		if err != nil && fErr == nil {
+			fErr = fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	var err error
+	tx.AmountPosted, err = parseTxsAmount(e.Amt.Value)
+	check("Amt", err)
+	tx.Currency = strings.ToUpper(strings.TrimSpace(e.Amt.Ccy))
+	if tx.Currency == "EUR" {
+		tx.AmountPostedEuro = tx.AmountPosted
+	}
+
+	switch strings.TrimSpace(e.CdtDbtInd) {
+	case "CRDT":
+		tx.DebitAccount, tx.CreditAccount = c.bankAccount, c.contraAccount
+	case "DBIT":
+		tx.DebitAccount, tx.CreditAccount = c.contraAccount, c.bankAccount
+	default:
+		check("CdtDbtInd", fmt.Errorf("Expect CRDT or DBIT was %q", e.CdtDbtInd))
+	}
+
+	tx.DateOfEntry, err = e.BookgDt.time()
+	check("BookgDt", err)
+	tx.DocDate, err = e.ValDt.time()
+	check("ValDt", err)
+	if tx.DocDate.IsZero() {
+		tx.DocDate = tx.DateOfEntry
+	}
+
+	text := []string{}
+	tx.DocNumber = strings.TrimSpace(e.AcctSvcrRef)
+	for _, d := range e.TxDtls {
+		id := strings.TrimSpace(d.EndToEndID)
+		if tx.DocNumber == "" && id != "" && id != "NOTPROVIDED" {
+			tx.DocNumber = id
+		}
+		for _, u := range d.Ustrd {
+			text = append(text, strings.TrimSpace(u))
+		}
+	}
+	tx.PostingText = strings.Join(text, " ")
+	if tx.PostingText == "" {
+		tx.PostingText = strings.TrimSpace(e.AddtlNtryInf)
+	}
+
+	return tx, fErr
+}
+
+func (c *camtReader) Line() int {
+	return c.line
+}
+
+func (d camtDate) time() (time.Time, error) {
+	s := strings.TrimSpace(d.Dt)
+	if s == "" && len(strings.TrimSpace(d.DtTm)) >= 10 {
+		s = strings.TrimSpace(d.DtTm)[:10]
+	}
+
+	return parseTxsDate(s)
+}
@@ -0,0 +1,109 @@
+package cmds
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"strings"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+type (
+	// txsCSVReader reads CSV files with a header of the accounting data
+	// column names, e.g. a corrected rejects file. Unknown columns are
+	// ignored, the separator is ; or ,.
+	txsCSVReader struct {
+		r    *csv.Reader
+		cols map[string]int
+		line int
+	}
+)
+
+func detectTxsCSV(head []byte) bool {
+	l := strings.ToLower(firstLine(head))
+	return strings.Contains(l, "doc_date") && strings.Contains(l, "amount_posted")
+}
+
+func openTxsCSV(r *bufio.Reader, opts ImportTxsOpts) (txsReader, error) {
+	head, _ := r.Peek(txsHeadSize)
+
+	c := csv.NewReader(r)
+	c.Comma = csvComma(firstLine(head))
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+
+	header, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+
+	for _, name := range []string{"doc_date", "amount_posted"} {
+		if _, ok := cols[name]; !ok {
+			return nil, fmt.Errorf("Missing column %v", name)
+		}
+	}
+
+	return &txsCSVReader{r: c, cols: cols, line: 1}, nil
+}
+
+func (r *txsCSVReader) Read() (accountingData.AccountingData, error) {
+	tx := accountingData.AccountingData{}
+
+	rec, err := r.r.Read()
+	if pErr, ok := err.(*csv.ParseError); ok {
+		r.line = pErr.Line
+	}
+	if err != nil {
+		return tx, err
+	}
+	r.line, _ = r.r.FieldPos(0)
+
+	get := func(name string) string {
+		i, ok := r.cols[name]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return txsText(rec[i])
+	}
+
+	var fErr error
+	check := func(name string, err error) {
+		if err != nil && fErr == nil {
+			fErr = fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	tx.DocDate, err = parseTxsDate(get("doc_date"))
+	check("doc_date", err)
+	tx.DateOfEntry, err = parseTxsDate(get("date_of_entry"))
+	check("date_of_entry", err)
+	tx.AmountPosted, err = parseTxsAmount(get("amount_posted"))
+	check("amount_posted", err)
+	tx.AmountPostedEuro, err = parseTxsAmount(get("amount_posted_euro"))
+	check("amount_posted_euro", err)
+	tx.DebitAccount, err = parseTxsInt(get("debit_account"))
+	check("debit_account", err)
+	tx.CreditAccount, err = parseTxsInt(get("credit_account"))
+	check("credit_account", err)
+	tx.TaxCode, err = parseTxsInt(get("tax_code"))
+	check("tax_code", err)
+
+	tx.DocNumberRange = get("doc_number_range")
+	tx.DocNumber = get("doc_number")
+	tx.PostingText = get("posting_text")
+	tx.CostUnit1 = get("cost_unit1")
+	tx.CostUnit2 = get("cost_unit2")
+	tx.Currency = get("currency")
+
+	return tx, fErr
+}
+
+func (r *txsCSVReader) Line() int {
+	return r.line
+}
@@ -0,0 +1,231 @@
+package cmds
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+const (
+	// Fields of the first line of an EXTF or DTVF file
+	datevCreatedField   = 5
+	datevYearStartField = 12
+)
+
+type (
+	// datevReader reads DATEV Buchungsstapel exports. EXTF and DTVF
+	// files start with a line of meta data, plain ASCII exports with the
+	// column names. Columns are found by their names.
+	datevReader struct {
+		r         *csv.Reader
+		cols      map[string]int
+		created   time.Time
+		yearStart time.Time
+		line      int
+	}
+)
+
+// datevColumns are the prefixes of the lower case column names.
+var datevColumns = map[string]string{
+	"amount":     "umsatz",
+	"debit":      "soll/haben",
+	"currency":   "wkz umsatz",
+	"base":       "basis-umsatz",
+	"account":    "konto",
+	"contra":     "gegenkonto",
+	"tax":        "bu-schl",
+	"doc_date":   "belegdatum",
+	"doc_number": "belegfeld 1",
+	"text":       "buchungstext",
+	"cost1":      "kost1",
+	"cost2":      "kost2",
+}
+
+func detectDatev(head []byte) bool {
+	l := strings.ToLower(strings.TrimLeft(firstLine(head), `"`))
+	return strings.HasPrefix(l, "extf") ||
+		strings.HasPrefix(l, "dtvf") ||
+		strings.HasPrefix(l, "umsatz")
+}
+
+func openDatev(r *bufio.Reader, opts ImportTxsOpts) (txsReader, error) {
+	c := csv.NewReader(r)
+	c.Comma = ';'
+	c.FieldsPerRecord = -1
+	c.LazyQuotes = true
+
+	d := &datevReader{r: c}
+
+	header, err := c.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	meta := strings.ToUpper(strings.TrimSpace(header[0]))
+	if meta == "EXTF" || meta == "DTVF" {
+		if len(header) > datevYearStartField {
+			d.created = datevMetaDate(header[datevCreatedField])
+			d.yearStart = datevMetaDate(header[datevYearStartField])
+		}
+
+		header, err = c.Read()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.cols, err = datevColumnIndex(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// datevColumnIndex finds the columns of datevColumns in header. Konto
+// has to match exactly, all other names are prefixes.
+func datevColumnIndex(header []string) (map[string]int, error) {
+	r := map[string]int{}
+	for key, prefix := range datevColumns {
+		for i, h := range header {
+			h = strings.ToLower(txsText(h))
+			if h == prefix || (key != "account" && strings.HasPrefix(h, prefix)) {
+				r[key] = i
+				break
+			}
+		}
+	}
+
+	for _, key := range []string{"amount", "debit", "account", "contra", "doc_date"} {
+		if _, ok := r[key]; !ok {
+			return nil, fmt.Errorf("Missing DATEV column %v", datevColumns[key])
+		}
+	}
+
+	return r, nil
+}
+
+func (d *datevReader) Read() (accountingData.AccountingData, error) {
+	tx := accountingData.AccountingData{}
+
+	rec, err := d.r.Read()
+	if pErr, ok := err.(*csv.ParseError); ok {
+		d.line = pErr.Line
+	}
+	if err != nil {
+		return tx, err
+	}
+	d.line, _ = d.r.FieldPos(0)
+
+	get := func(key string) string {
+		i, ok := d.cols[key]
+		if !ok || i >= len(rec) {
+			return ""
+		}
+		return txsText(rec[i])
+	}
+
+	var fErr error
+	check := func(name string, err error) {
+		if err != nil && fErr == nil {
+			fErr = fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	tx.AmountPosted, err = parseTxsAmount(get("amount"))
+	check(datevColumns["amount"], err)
+
+	account, err := parseTxsInt(get("account"))
+	check(datevColumns["account"], err)
+	contra, err := parseTxsInt(get("contra"))
+	check(datevColumns["contra"], err)
+
+	switch strings.ToUpper(get("debit")) {
+	case "S":
+		tx.DebitAccount, tx.CreditAccount = account, contra
+	case "H":
+		tx.DebitAccount, tx.CreditAccount = contra, account
+	default:
+		check(datevColumns["debit"], fmt.Errorf("Expect S or H was %q", get("debit")))
+	}
+
+	tx.TaxCode, err = parseTxsInt(get("tax"))
+	check(datevColumns["tax"], err)
+
+	tx.DocDate, err = d.date(get("doc_date"))
+	check(datevColumns["doc_date"], err)
+	tx.DateOfEntry = d.created
+	if tx.DateOfEntry.IsZero() {
+		tx.DateOfEntry = tx.DocDate
+	}
+
+	tx.Currency = strings.ToUpper(get("currency"))
+	tx.AmountPostedEuro, err = parseTxsAmount(get("base"))
+	check(datevColumns["base"], err)
+	if tx.AmountPostedEuro == 0 && (tx.Currency == "" || tx.Currency == "EUR") {
+		tx.AmountPostedEuro = tx.AmountPosted
+	}
+
+	tx.DocNumber = get("doc_number")
+	tx.PostingText = get("text")
+	tx.CostUnit1 = get("cost1")
+	tx.CostUnit2 = get("cost2")
+
+	return tx, fErr
+}
+
+func (d *datevReader) Line() int {
+	return d.line
+}
+
+// date reads the Belegdatum as DDMMYYYY or as DDMM in the fiscal year
+// of the meta data. Leading zeros are often lost.
+func (d *datevReader) date(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if len(s) > 4 {
+		return time.Parse("02012006", zeroPad(s, 8))
+	}
+
+	if d.yearStart.IsZero() {
+		return time.Time{}, fmt.Errorf("Date %q without year and no fiscal year in the header", s)
+	}
+
+	t, err := time.Parse("0201", zeroPad(s, 4))
+	if err != nil {
+		return t, err
+	}
+
+	year := d.yearStart.Year()
+	if t.Month() < d.yearStart.Month() {
+		year++
+	}
+
+	return time.Date(year, t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// datevMetaDate reads the date of a YYYYMMDD... field of the meta data,
+// it is zero if the field is empty.
+func datevMetaDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	if len(s) < 8 {
+		return time.Time{}
+	}
+
+	t, _ := time.Parse("20060102", s[:8])
+	return t
+}
+
+func zeroPad(s string, n int) string {
+	if len(s) >= n {
+		return s
+	}
+
+	return strings.Repeat("0", n-len(s)) + s
+}
@@ -0,0 +1,209 @@
+package cmds
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+
+	"github.com/tochti/docMa-accountant/accountantService/accountingTxsFileReader"
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+const (
+	// Bytes of a txs file looked at to detect the format
+	txsHeadSize = 4096
+)
+
+type (
+	// txsFormat is a file format of accounting transactions. Detect is
+	// called with the head of the file, the first format which detects
+	// the file reads it.
+	txsFormat struct {
+		Name   string
+		Detect func(head []byte) bool
+		Open   func(r *bufio.Reader, opts ImportTxsOpts) (txsReader, error)
+	}
+
+	// accountantReader passes the records of the accountant format one
+	// by one to the reader of the accountant, which does not know the
+	// line of a transaction.
+	accountantReader struct {
+		r *bufio.Reader
+		// line of the last record, next is the line after it
+		line int
+		next int
+	}
+)
+
+var (
+	// txsFormats in the order they are detected, accountant is the
+	// fallback
+	txsFormats = []txsFormat{
+		{Name: "camt053", Detect: detectCamt053, Open: openCamt053},
+		{Name: "datev", Detect: detectDatev, Open: openDatev},
+		{Name: "csv", Detect: detectTxsCSV, Open: openTxsCSV},
+		{Name: "accountant", Detect: func([]byte) bool { return true }, Open: openAccountant},
+	}
+
+	utf8BOM = []byte("\xef\xbb\xbf")
+)
+
+// TxsFormatNames returns the names of all txs file formats.
+func TxsFormatNames() []string {
+	r := []string{}
+	for _, f := range txsFormats {
+		r = append(r, f.Name)
+	}
+
+	return r
+}
+
+// openTxsReader returns a reader for r in format or in the detected
+// format if format is empty.
+func openTxsReader(r io.Reader, format string, opts ImportTxsOpts) (txsReader, string, error) {
+	br := bufio.NewReaderSize(r, txsHeadSize)
+	head, err := br.Peek(txsHeadSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+	if bytes.HasPrefix(head, utf8BOM) {
+		br.Discard(len(utf8BOM))
+		head = head[len(utf8BOM):]
+	}
+
+	for _, f := range txsFormats {
+		if (format == "" && f.Detect(head)) || format == f.Name {
+			reader, err := f.Open(br, opts)
+			return reader, f.Name, err
+		}
+	}
+
+	return nil, "", fmt.Errorf("Unknown txs format %v, known are %v", format, strings.Join(TxsFormatNames(), ", "))
+}
+
+func openAccountant(r *bufio.Reader, opts ImportTxsOpts) (txsReader, error) {
+	return &accountantReader{r: r, next: 1}, nil
+}
+
+// Read reads the next record, a record ends with the first line break
+// outside of quotes. Empty lines are skipped.
+func (a *accountantReader) Read() (accountingData.AccountingData, error) {
+	record := ""
+	for {
+		l, err := a.r.ReadString('\n')
+		if record == "" && strings.TrimSpace(l) == "" {
+			if err != nil {
+				return accountingData.AccountingData{}, err
+			}
+			a.next++
+			continue
+		}
+
+		if record == "" {
+			a.line = a.next
+		}
+		record += l
+		if strings.HasSuffix(l, "\n") {
+			a.next++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return accountingData.AccountingData{}, err
+		}
+		if strings.Count(record, `"`)%2 == 0 {
+			break
+		}
+	}
+
+	return accountingTxsFileReader.NewReader(strings.NewReader(record)).Read()
+}
+
+func (a *accountantReader) Line() int {
+	return a.line
+}
+
+// firstLine returns the first line of head without line break.
+func firstLine(head []byte) string {
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+
+	return strings.TrimRight(string(head), "\r")
+}
+
+// csvComma guesses the separator of a header line.
+func csvComma(header string) rune {
+	if strings.Count(header, ";") >= strings.Count(header, ",") {
+		return ';'
+	}
+
+	return ','
+}
+
+// txsText returns s as UTF-8, exports of windows programs are often
+// Windows-1252.
+func txsText(s string) string {
+	s = strings.TrimSpace(s)
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	r, err := charmap.Windows1252.NewDecoder().String(s)
+	if err != nil {
+		return s
+	}
+
+	return r
+}
+
+// parseTxsAmount reads 1234.56 and the German 1.234,56.
+func parseTxsAmount(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	if strings.Contains(s, ",") {
+		s = strings.Replace(s, ".", "", -1)
+		s = strings.Replace(s, ",", ".", 1)
+	}
+
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseTxsInt(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(s)
+}
+
+// parseTxsDate reads ISO dates and the German 02.01.2006. An empty
+// date is the zero time which fails validation.
+func parseTxsDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{"2006-01-02", "02.01.2006", "2006-01-02T15:04:05"} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid date %q", s)
+}
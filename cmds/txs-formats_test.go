@@ -0,0 +1,231 @@
+package cmds
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testDatev = `"EXTF";700;21;"Buchungsstapel";12;20150105120000000;;"";"";"";12345;67890;20140101;4;20140101;20141231
+Umsatz (ohne Soll/Haben-Kz);Soll/Haben-Kennzeichen;WKZ Umsatz;Kurs;Basis-Umsatz;WKZ Basis-Umsatz;Konto;Gegenkonto (ohne BU-Schlüssel);BU-Schlüssel;Belegdatum;Belegfeld 1;Belegfeld 2;Skonto;Buchungstext;KOST1 - Kostenstelle
+1.190,00;H;EUR;;;;8400;10000;3;1503;RE-1;;;"Rechnung 1";K1
+50,00;S;;;;;4930;1200;;112;RE-2;;;Büro;
+`
+
+	testTxsCSV = "line;problems;doc_date;date_of_entry;doc_number_range;doc_number;posting_text;amount_posted;debit_account;credit_account;tax_code;cost_unit1;cost_unit2;amount_posted_euro;currency\n" +
+		"3;tax_code: too big;2014-01-01;2014-01-02;R;DN1;Text;10.5;1400;8400;3;;;10.5;EUR\n" +
+		"4;;01.02.2014;;;DN2;;x;1400;8400;;;;;\n"
+
+	testCamt = `<?xml version="1.0" encoding="UTF-8"?>
+<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.02">
+  <BkToCstmrStmt>
+    <Stmt>
+      <Ntry>
+        <Amt Ccy="EUR">100.00</Amt>
+        <CdtDbtInd>CRDT</CdtDbtInd>
+        <BookgDt><Dt>2014-03-01</Dt></BookgDt>
+        <ValDt><Dt>2014-02-28</Dt></ValDt>
+        <AcctSvcrRef>REF1</AcctSvcrRef>
+        <NtryDtls><TxDtls><RmtInf><Ustrd>RE-1</Ustrd><Ustrd>Kunde</Ustrd></RmtInf></TxDtls></NtryDtls>
+      </Ntry>
+      <Ntry>
+        <Amt Ccy="EUR">20.00</Amt>
+        <CdtDbtInd>DBIT</CdtDbtInd>
+        <BookgDt><DtTm>2014-03-02T10:00:00</DtTm></BookgDt>
+        <NtryDtls><TxDtls><Refs><EndToEndId>E2E</EndToEndId></Refs></TxDtls></NtryDtls>
+      </Ntry>
+    </Stmt>
+  </BkToCstmrStmt>
+</Document>
+`
+)
+
+func Test_DetectTxsFormat(t *testing.T) {
+	opts := ImportTxsOpts{BankAccount: 1200, ContraAccount: 1590}
+	for expect, data := range map[string]string{
+		"datev":      testDatev,
+		"csv":        "\xef\xbb\xbf" + testTxsCSV,
+		"camt053":    testCamt,
+		"accountant": "1;2;3\n",
+	} {
+		_, format, err := openTxsReader(strings.NewReader(data), "", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != expect {
+			t.Fatalf("Expect %v was %v", expect, format)
+		}
+	}
+
+	_, format, err := openTxsReader(strings.NewReader(testTxsCSV), "datev", opts)
+	if err == nil || format != "datev" {
+		t.Fatalf("Expect %v was %v", "datev error", err)
+	}
+
+	_, _, err = openTxsReader(strings.NewReader(testTxsCSV), "xls", opts)
+	if err == nil {
+		t.Fatalf("Expect %v was %v", "error", err)
+	}
+}
+
+func Test_DatevReader(t *testing.T) {
+	r, _, err := openTxsReader(strings.NewReader(testDatev), "", ImportTxsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docDate := time.Date(2014, 3, 15, 0, 0, 0, 0, time.UTC)
+	entry := time.Date(2015, 1, 5, 0, 0, 0, 0, time.UTC)
+	if tx.AmountPosted != 1190 ||
+		tx.AmountPostedEuro != 1190 ||
+		tx.DebitAccount != 10000 ||
+		tx.CreditAccount != 8400 ||
+		tx.TaxCode != 3 ||
+		!tx.DocDate.Equal(docDate) ||
+		!tx.DateOfEntry.Equal(entry) ||
+		tx.DocNumber != "RE-1" ||
+		tx.PostingText != "Rechnung 1" ||
+		tx.CostUnit1 != "K1" ||
+		tx.Currency != "EUR" {
+		t.Fatalf("Expect %v was %v", "first booking", tx)
+	}
+	if r.(liner).Line() != 3 {
+		t.Fatalf("Expect %v was %v", 3, r.(liner).Line())
+	}
+
+	tx, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docDate = time.Date(2014, 12, 1, 0, 0, 0, 0, time.UTC)
+	if tx.DebitAccount != 4930 || tx.CreditAccount != 1200 || !tx.DocDate.Equal(docDate) || tx.PostingText != "Büro" {
+		t.Fatalf("Expect %v was %v", "second booking", tx)
+	}
+
+	_, err = r.Read()
+	if err != io.EOF {
+		t.Fatalf("Expect %v was %v", io.EOF, err)
+	}
+}
+
+func Test_DatevReader_Windows1252(t *testing.T) {
+	data := strings.Replace(testDatev, "Büro", "B\xfcro", 1)
+	data = strings.Replace(data, "Schlüssel", "Schl\xfcssel", -1)
+	r, _, err := openTxsReader(strings.NewReader(data), "", ImportTxsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Read()
+	tx, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.PostingText != "Büro" {
+		t.Fatalf("Expect %v was %v", "Büro", tx.PostingText)
+	}
+}
+
+func Test_TxsCSVReader(t *testing.T) {
+	r, _, err := openTxsReader(strings.NewReader(testTxsCSV), "", ImportTxsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.DocNumberRange != "R" ||
+		tx.DocNumber != "DN1" ||
+		tx.AmountPosted != 10.5 ||
+		tx.DebitAccount != 1400 ||
+		!tx.DateOfEntry.Equal(time.Date(2014, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expect %v was %v", "DN1", tx)
+	}
+
+	tx, err = r.Read()
+	if err == nil || !strings.HasPrefix(err.Error(), "amount_posted") {
+		t.Fatalf("Expect %v was %v", "amount_posted error", err)
+	}
+	if r.(liner).Line() != 3 || !tx.DocDate.Equal(time.Date(2014, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Expect %v was %v", "line 3", r.(liner).Line())
+	}
+}
+
+func Test_CamtReader(t *testing.T) {
+	_, _, err := openTxsReader(strings.NewReader(testCamt), "", ImportTxsOpts{})
+	if err == nil {
+		t.Fatalf("Expect %v was %v", "missing accounts error", err)
+	}
+
+	r, _, err := openTxsReader(strings.NewReader(testCamt), "", ImportTxsOpts{BankAccount: 1200, ContraAccount: 1590})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.AmountPosted != 100 ||
+		tx.DebitAccount != 1200 ||
+		tx.CreditAccount != 1590 ||
+		!tx.DocDate.Equal(time.Date(2014, 2, 28, 0, 0, 0, 0, time.UTC)) ||
+		!tx.DateOfEntry.Equal(time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)) ||
+		tx.DocNumber != "REF1" ||
+		tx.PostingText != "RE-1 Kunde" {
+		t.Fatalf("Expect %v was %v", "credit entry", tx)
+	}
+	if r.(liner).Line() != 5 {
+		t.Fatalf("Expect %v was %v", 5, r.(liner).Line())
+	}
+
+	tx, err = r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.DebitAccount != 1590 || tx.CreditAccount != 1200 || tx.DocNumber != "E2E" || !tx.DocDate.Equal(tx.DateOfEntry) {
+		t.Fatalf("Expect %v was %v", "debit entry", tx)
+	}
+	if r.(liner).Line() != 13 {
+		t.Fatalf("Expect %v was %v", 13, r.(liner).Line())
+	}
+
+	_, err = r.Read()
+	if err != io.EOF {
+		t.Fatalf("Expect %v was %v", io.EOF, err)
+	}
+}
+
+func Test_AccountantReader(t *testing.T) {
+	data := "1;2;3\n\n\"Posting\ntext\";5\r\n6;7"
+	r, format, err := openTxsReader(strings.NewReader(data), "", ImportTxsOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "accountant" {
+		t.Fatalf("Expect %v was %v", "accountant", format)
+	}
+
+	rows, err := readTxsRows(r, DefaultTxsRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []int{1, 3, 5}
+	if len(rows) != len(expect) {
+		t.Fatalf("Expect %v was %v", expect, rows)
+	}
+	for i, l := range expect {
+		if rows[i].Line != l {
+			t.Fatalf("Expect %v was %v", l, rows[i].Line)
+		}
+	}
+}
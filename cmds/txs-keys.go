@@ -0,0 +1,213 @@
+package cmds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+// What the import does with transactions which already exist
+const (
+	// TxsDuplicateUpdate overwrites the stored transaction if any field
+	// changed
+	TxsDuplicateUpdate TxsDuplicatePolicy = iota
+	// TxsDuplicateSkip leaves the stored transaction untouched
+	TxsDuplicateSkip
+)
+
+type (
+	TxsDuplicatePolicy int
+
+	// txsKey identifies a stored transaction. NaturalKey is the hash of
+	// the fields which make up a transaction, Occurrence counts equal
+	// natural keys within one export and RowHash changes with any field.
+	txsKey struct {
+		ID         int64  `db:"accounting_data_id"`
+		NaturalKey string `db:"natural_key"`
+		Occurrence int    `db:"occurrence"`
+		RowHash    string `db:"row_hash"`
+	}
+)
+
+func (k txsKey) id() string {
+	return fmt.Sprintf("%v/%v", k.NaturalKey, k.Occurrence)
+}
+
+// txsNaturalKey hashes doc number range, doc number, doc date, amount
+// and accounts.
+func txsNaturalKey(tx accountingData.AccountingData) string {
+	return hashFields(
+		tx.DocNumberRange,
+		tx.DocNumber,
+		txsDate(tx.DocDate),
+		txsAmount(tx.AmountPosted),
+		strconv.Itoa(tx.DebitAccount),
+		strconv.Itoa(tx.CreditAccount),
+	)
+}
+
+// txsRowHash hashes all fields except the id.
+func txsRowHash(tx accountingData.AccountingData) string {
+	return hashFields(
+		txsDate(tx.DocDate),
+		txsDate(tx.DateOfEntry),
+		tx.DocNumberRange,
+		tx.DocNumber,
+		tx.PostingText,
+		txsAmount(tx.AmountPosted),
+		strconv.Itoa(tx.DebitAccount),
+		strconv.Itoa(tx.CreditAccount),
+		strconv.Itoa(tx.TaxCode),
+		tx.CostUnit1,
+		tx.CostUnit2,
+		txsAmount(tx.AmountPostedEuro),
+		tx.Currency,
+	)
+}
+
+func hashFields(fields ...string) string {
+	h := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+func txsAmount(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// keyTxs sets the keys of rows. The n-th transaction with the same
+// natural key gets occurrence n, so equal transactions in one export
+// are kept apart.
+func keyTxs(rows []txsRow) {
+	seen := map[string]int{}
+	for i := range rows {
+		nk := txsNaturalKey(rows[i].Tx)
+		rows[i].Key = txsKey{
+			NaturalKey: nk,
+			Occurrence: seen[nk],
+			RowHash:    txsRowHash(rows[i].Tx),
+		}
+		seen[nk]++
+	}
+}
+
+// planTxs sorts rows into transactions to insert and to update. Rows to
+// update get the id of the stored transaction.
+func planTxs(rows []txsRow, keys map[string]txsKey, policy TxsDuplicatePolicy) ([]txsRow, []txsRow, int) {
+	keyTxs(rows)
+
+	insert := []txsRow{}
+	update := []txsRow{}
+	skipped := 0
+	for _, r := range rows {
+		stored, ok := keys[r.Key.id()]
+		switch {
+		case !ok:
+			insert = append(insert, r)
+		case stored.RowHash == r.Key.RowHash || policy == TxsDuplicateSkip:
+			skipped++
+		default:
+			r.Key.ID = stored.ID
+			r.Tx.ID = stored.ID
+			update = append(update, r)
+		}
+	}
+
+	return insert, update, skipped
+}
+
+// readTxsKeys returns the keys of all stored transactions by txsKey.id.
+func readTxsKeys(db gorp.SqlExecutor) (map[string]txsKey, error) {
+	rows := []txsKey{}
+	q := fmt.Sprintf("SELECT * FROM %v", TxsKeysTable)
+	_, err := db.Select(&rows, q)
+	if err != nil {
+		return nil, err
+	}
+
+	r := map[string]txsKey{}
+	for _, k := range rows {
+		r[k.id()] = k
+	}
+
+	return r, nil
+}
+
+// backfillTxsKeys stores the keys of transactions which have none,
+// e.g. transactions imported before keys were stored. keys is updated.
+func backfillTxsKeys(db gorp.SqlExecutor, keys map[string]txsKey) (int, error) {
+	txs := []accountingData.AccountingData{}
+	q := fmt.Sprintf(`
+		SELECT a.* FROM %v AS a
+		LEFT JOIN %v AS k ON k.accounting_data_id=a.id
+		WHERE k.accounting_data_id IS NULL
+		ORDER BY a.id`,
+		accountingData.AccountingDataTable, TxsKeysTable)
+	_, err := db.Select(&txs, q)
+	if err != nil {
+		return 0, err
+	}
+
+	next := map[string]int{}
+	for _, k := range keys {
+		if k.Occurrence >= next[k.NaturalKey] {
+			next[k.NaturalKey] = k.Occurrence + 1
+		}
+	}
+
+	add := []txsKey{}
+	for _, tx := range txs {
+		nk := txsNaturalKey(tx)
+		k := txsKey{
+			ID:         tx.ID,
+			NaturalKey: nk,
+			Occurrence: next[nk],
+			RowHash:    txsRowHash(tx),
+		}
+		next[nk]++
+		add = append(add, k)
+	}
+
+	err = saveTxsKeys(db, add)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, k := range add {
+		keys[k.id()] = k
+	}
+
+	return len(add), nil
+}
+
+func saveTxsKeys(db gorp.SqlExecutor, keys []txsKey) error {
+	data := make([]interface{}, len(keys))
+	for i, k := range keys {
+		data[i] = k
+	}
+
+	fields := []string{"accounting_data_id", "natural_key", "occurrence", "row_hash"}
+	suffix := " ON DUPLICATE KEY UPDATE natural_key=VALUES(natural_key), occurrence=VALUES(occurrence), row_hash=VALUES(row_hash)"
+	values := func(i interface{}) []interface{} {
+		k := i.(txsKey)
+		return []interface{}{k.ID, k.NaturalKey, k.Occurrence, k.RowHash}
+	}
+
+	return batchInsert(db, "INSERT", suffix, fields, data, TxsKeysTable, values, Chunker{})
+}
+
+func ParseTxsDuplicatePolicy(s string) (TxsDuplicatePolicy, error) {
+	switch s {
+	case "update":
+		return TxsDuplicateUpdate, nil
+	case "skip":
+		return TxsDuplicateSkip, nil
+	}
+
+	return TxsDuplicateUpdate, fmt.Errorf("Unknown duplicate transaction policy %v", s)
+}
@@ -0,0 +1,69 @@
+package cmds
+
+import (
+	"testing"
+)
+
+func Test_TxsNaturalKey(t *testing.T) {
+	tx := validTx()
+	nk := txsNaturalKey(tx)
+	hash := txsRowHash(tx)
+
+	other := validTx()
+	other.PostingText = "Changed"
+	if txsNaturalKey(other) != nk {
+		t.Fatalf("Expect %v was %v", nk, txsNaturalKey(other))
+	}
+	if txsRowHash(other) == hash {
+		t.Fatalf("Expect %v was %v", "other row hash", hash)
+	}
+
+	other = validTx()
+	other.AmountPosted = 10.51
+	if txsNaturalKey(other) == nk {
+		t.Fatalf("Expect %v was %v", "other natural key", nk)
+	}
+}
+
+func Test_PlanTxs(t *testing.T) {
+	same := validTx()
+	changed := validTx()
+	changed.DocNumber = "DN2"
+	added := validTx()
+	added.DocNumber = "DN3"
+
+	keys := map[string]txsKey{}
+	for i, tx := range []txsRow{{Tx: same}, {Tx: changed}} {
+		k := txsKey{
+			ID:         int64(i + 1),
+			NaturalKey: txsNaturalKey(tx.Tx),
+			RowHash:    txsRowHash(tx.Tx),
+		}
+		keys[k.id()] = k
+	}
+
+	changed.PostingText = "Changed"
+	rows := []txsRow{
+		{Line: 1, Tx: same},
+		{Line: 2, Tx: changed},
+		{Line: 3, Tx: added},
+		// Equal to line 1 but a transaction of its own
+		{Line: 4, Tx: same},
+	}
+
+	insert, update, skipped := planTxs(rows, keys, TxsDuplicateUpdate)
+	if skipped != 1 {
+		t.Fatalf("Expect %v was %v", 1, skipped)
+	}
+	if len(update) != 1 || update[0].Line != 2 || update[0].Tx.ID != 2 || update[0].Key.ID != 2 {
+		t.Fatalf("Expect %v was %v", "line 2 updates id 2", update)
+	}
+	if len(insert) != 2 || insert[0].Line != 3 || insert[1].Line != 4 || insert[1].Key.Occurrence != 1 {
+		t.Fatalf("Expect %v was %v", "lines 3 and 4 inserted", insert)
+	}
+
+	insert, update, skipped = planTxs(rows, keys, TxsDuplicateSkip)
+	if skipped != 2 || len(update) != 0 || len(insert) != 2 {
+		t.Fatalf("Expect %v was %v", "2 skipped", skipped)
+	}
+}
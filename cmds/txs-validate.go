@@ -0,0 +1,131 @@
+package cmds
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+type (
+	// TxsRules are the checks every accounting transaction has to pass
+	// before it is imported.
+	TxsRules struct {
+		MinAccount int
+		MaxAccount int
+		MaxTaxCode int
+		// Currencies allowed, empty allows every ISO 4217 like code.
+		// A missing currency is the currency of the books.
+		Currencies []string
+	}
+
+	// TxsProblem is one failed check of the transaction in Line.
+	TxsProblem struct {
+		Line  int    `json:"line"`
+		Field string `json:"field"`
+		Error string `json:"error"`
+	}
+
+	TxsReport struct {
+		Format      string       `json:"format"`
+		Problems    []TxsProblem `json:"problems"`
+		Rejected    int          `json:"rejected"`
+		RejectsFile string       `json:"rejects_file,omitempty"`
+	}
+)
+
+var (
+	DefaultTxsRules = TxsRules{
+		MinAccount: 1,
+		MaxAccount: 999999999,
+		MaxTaxCode: 99,
+	}
+
+	currencyRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// Validate returns all problems of tx. Dates which could not be parsed
+// are zero, amounts have to be positive because the direction is given
+// by the debit and credit account.
+func (rules TxsRules) Validate(line int, tx accountingData.AccountingData) []TxsProblem {
+	r := []TxsProblem{}
+	add := func(field, format string, v ...interface{}) {
+		r = append(r, TxsProblem{Line: line, Field: field, Error: fmt.Sprintf(format, v...)})
+	}
+
+	if tx.DocDate.IsZero() {
+		add("doc_date", "Missing or invalid date")
+	}
+	if tx.DateOfEntry.IsZero() {
+		add("date_of_entry", "Missing or invalid date")
+	}
+
+	if !rules.account(tx.DebitAccount) {
+		add("debit_account", "Account %v not in %v - %v", tx.DebitAccount, rules.MinAccount, rules.MaxAccount)
+	}
+	if !rules.account(tx.CreditAccount) {
+		add("credit_account", "Account %v not in %v - %v", tx.CreditAccount, rules.MinAccount, rules.MaxAccount)
+	}
+	if tx.DebitAccount == tx.CreditAccount {
+		add("credit_account", "Same account %v on both sides", tx.CreditAccount)
+	}
+
+	if tx.TaxCode < 0 || tx.TaxCode > rules.MaxTaxCode {
+		add("tax_code", "Tax code %v not in 0 - %v", tx.TaxCode, rules.MaxTaxCode)
+	}
+
+	if !rules.currency(tx.Currency) {
+		add("currency", "Unknown currency %q", tx.Currency)
+	}
+
+	if tx.AmountPosted <= 0 {
+		add("amount_posted", "Amount %v is not positive", tx.AmountPosted)
+	}
+	if tx.AmountPostedEuro < 0 {
+		add("amount_posted_euro", "Amount %v is negative", tx.AmountPostedEuro)
+	}
+
+	return r
+}
+
+func (rules TxsRules) account(a int) bool {
+	return a >= rules.MinAccount && a <= rules.MaxAccount
+}
+
+func (rules TxsRules) currency(c string) bool {
+	if c == "" {
+		return true
+	}
+	if len(rules.Currencies) == 0 {
+		return currencyRegexp.MatchString(c)
+	}
+
+	for _, a := range rules.Currencies {
+		if a == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r TxsReport) String() string {
+	buf := &bytes.Buffer{}
+	if r.Format != "" {
+		fmt.Fprintf(buf, "Read as %v\n", r.Format)
+	}
+
+	if len(r.Problems) > 0 {
+		fmt.Fprintf(buf, "Invalid transactions (%v problems):\n", len(r.Problems))
+		for _, p := range r.Problems {
+			fmt.Fprintf(buf, "  ! line %v: %v: %v\n", p.Line, p.Field, p.Error)
+		}
+	}
+
+	if r.RejectsFile != "" {
+		fmt.Fprintf(buf, "%v rejected transactions written to %v\n", r.Rejected, r.RejectsFile)
+	}
+
+	return buf.String()
+}
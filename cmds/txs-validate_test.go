@@ -0,0 +1,148 @@
+package cmds
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tochti/docMa-handler/accountingData"
+)
+
+type fakeTxsReader struct {
+	rows []interface{}
+	line int
+}
+
+func (r *fakeTxsReader) Read() (accountingData.AccountingData, error) {
+	if len(r.rows) == 0 {
+		return accountingData.AccountingData{}, io.EOF
+	}
+
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	r.line += 2
+	if err, ok := row.(error); ok {
+		return accountingData.AccountingData{}, err
+	}
+
+	return row.(accountingData.AccountingData), nil
+}
+
+func (r *fakeTxsReader) Line() int {
+	return r.line
+}
+
+func validTx() accountingData.AccountingData {
+	d := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	return accountingData.AccountingData{
+		DocDate:          d,
+		DateOfEntry:      d,
+		DocNumber:        "DN1",
+		AmountPosted:     10.5,
+		DebitAccount:     1400,
+		CreditAccount:    8400,
+		TaxCode:          3,
+		AmountPostedEuro: 10.5,
+		Currency:         "EUR",
+	}
+}
+
+func Test_TxsRules_Validate(t *testing.T) {
+	r := DefaultTxsRules.Validate(1, validTx())
+	if len(r) != 0 {
+		t.Fatalf("Expect %v was %v", 0, r)
+	}
+
+	tx := validTx()
+	tx.DocDate = time.Time{}
+	tx.CreditAccount = tx.DebitAccount
+	tx.Currency = "euro"
+	tx.AmountPosted = 0
+	r = DefaultTxsRules.Validate(7, tx)
+	fields := []string{}
+	for _, p := range r {
+		if p.Line != 7 {
+			t.Fatalf("Expect %v was %v", 7, p.Line)
+		}
+		fields = append(fields, p.Field)
+	}
+	expect := "doc_date,credit_account,currency,amount_posted"
+	if strings.Join(fields, ",") != expect {
+		t.Fatalf("Expect %v was %v", expect, fields)
+	}
+
+	rules := DefaultTxsRules
+	rules.Currencies = []string{"EUR"}
+	tx = validTx()
+	tx.Currency = "USD"
+	r = rules.Validate(1, tx)
+	if len(r) != 1 || r[0].Field != "currency" {
+		t.Fatalf("Expect %v was %v", "currency", r)
+	}
+}
+
+func Test_ReadTxsRows(t *testing.T) {
+	invalid := validTx()
+	invalid.TaxCode = 100
+	reader := &fakeTxsReader{rows: []interface{}{
+		validTx(),
+		errors.New("Bad row"),
+		invalid,
+	}}
+
+	rows, err := readTxsRows(reader, DefaultTxsRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 3 {
+		t.Fatalf("Expect %v was %v", 3, len(rows))
+	}
+	if rows[0].Line != 2 || len(rows[0].Problems) != 0 {
+		t.Fatalf("Expect %v was %v", "valid row on line 2", rows[0])
+	}
+	if rows[1].Line != 4 || rows[1].Problems[0].Field != "row" {
+		t.Fatalf("Expect %v was %v", "read error on line 4", rows[1])
+	}
+	if rows[2].Line != 6 || rows[2].Problems[0].Field != "tax_code" {
+		t.Fatalf("Expect %v was %v", "tax code problem on line 6", rows[2])
+	}
+}
+
+func Test_WriteTxsRejects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tx := validTx()
+	tx.TaxCode = 100
+	rows := []txsRow{
+		{Line: 3, Tx: tx, Problems: DefaultTxsRules.Validate(3, tx)},
+	}
+
+	file := filepath.Join(dir, "rejects.csv")
+	err = writeTxsRejects(file, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expect %v was %v", 2, len(lines))
+	}
+	expect := "3;tax_code: Tax code 100 not in 0 - 99;2014-01-01;2014-01-01;;DN1;"
+	if !strings.HasPrefix(lines[1], expect) {
+		t.Fatalf("Expect %v was %v", expect, lines[1])
+	}
+}
@@ -15,7 +15,7 @@ func NewUser() error {
 
 	db, err := mysql.DB()
 	if err != nil {
-		return err
+		return NewError(KindDBConnection, err)
 	}
 	defer db.Close()
 
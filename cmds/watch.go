@@ -0,0 +1,450 @@
+package cmds
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/gorp.v1"
+
+	"github.com/tochti/docMa-handler/docs"
+	"github.com/tochti/docMa-handler/labels"
+)
+
+type (
+	WatchOpts struct {
+		ImportDocsOpts
+		// Settle is how long a file has to stay unchanged before it is
+		// imported, scanners write their files in several steps.
+		Settle time.Duration
+		// Interval is how often pending files are checked and, when
+		// polling, how often the directory is scanned.
+		Interval time.Duration
+		// Poll scans the directory instead of using inotify. Without
+		// inotify support the watcher always falls back to polling.
+		Poll bool
+		// Initial imports the files already in the directory on start
+		Initial bool
+		// Progress gets a line for every imported or rejected file
+		Progress io.Writer
+	}
+
+	// fileState is used to find out if a file is still written.
+	fileState struct {
+		Size    int64
+		ModTime time.Time
+	}
+
+	pendingFile struct {
+		State   fileState
+		Changed time.Time
+	}
+
+	docWatcher struct {
+		dir      string
+		opts     WatchOpts
+		db       *gorp.DbMap
+		labelIDs map[string]int64
+		notify   *fsnotify.Watcher
+		// pending files are waiting to settle, seen files are imported
+		// or were there on start. Both are keyed by the relative path.
+		pending map[string]*pendingFile
+		seen    map[string]fileState
+		result  *Result
+		report  *DocsReport
+	}
+)
+
+// WatchDocs imports new files in dir as they arrive until stop is
+// closed. Docs are written the same way ImportDocs writes them. The
+// watcher keeps running on invalid names, an invalid name policy of
+// InvalidAbort is rejected.
+func WatchDocs(dir string, opts WatchOpts, stop <-chan struct{}) (Result, error) {
+	result := NewResult()
+	report := DocsReport{
+		Invalid:    []InvalidFile{},
+		Duplicates: []DuplicateFile{},
+		NewLabels:  []string{},
+	}
+	result.Details = &report
+
+	if opts.OnInvalidName == InvalidAbort {
+		return result, NewError(KindConfig, fmt.Errorf("Invalid name policy abort is not supported by watch"))
+	}
+
+	db, err := openMySQL()
+	if err != nil {
+		return result, err
+	}
+
+	docs.AddTables(db)
+	labels.AddTables(db)
+
+	err = CreateCtrlTables(db)
+	if err != nil {
+		return result, err
+	}
+
+	opts.ImportDocsOpts, err = opts.ImportDocsOpts.prepare()
+	if err != nil {
+		return result, err
+	}
+	if opts.Settle <= 0 {
+		opts.Settle = 5 * time.Second
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.Progress == nil {
+		opts.Progress = ioutil.Discard
+	}
+
+	// Fail on start if the labels for all docs are missing
+	labelIDs, err := resolveLabels(db, opts.baseLabels(), opts.CreateLabels)
+	if err != nil {
+		return result, err
+	}
+
+	w := &docWatcher{
+		dir:      dir,
+		opts:     opts,
+		db:       db,
+		labelIDs: labelIDs,
+		pending:  map[string]*pendingFile{},
+		seen:     map[string]fileState{},
+		result:   &result,
+		report:   &report,
+	}
+
+	files, err := w.scan()
+	if err != nil {
+		return result, NewError(KindConfig, err)
+	}
+	for rel, state := range files {
+		if opts.Initial {
+			w.markPending(rel, state)
+		} else {
+			w.seen[rel] = state
+		}
+	}
+
+	if !opts.Poll {
+		err := w.startNotify()
+		if err != nil {
+			fmt.Fprintf(opts.Progress, "inotify not available (%v), polling every %v\n", err, opts.Interval)
+			w.opts.Poll = true
+		} else {
+			defer w.notify.Close()
+		}
+	}
+
+	return result, w.run(stop)
+}
+
+func (w *docWatcher) run(stop <-chan struct{}) error {
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+
+	var events chan fsnotify.Event
+	var errs chan error
+	if w.notify != nil {
+		events = w.notify.Events
+		errs = w.notify.Errors
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case ev := <-events:
+			w.handleEvent(ev)
+
+		case err := <-errs:
+			log.Println(err)
+			w.result.AddError("%v", err)
+
+		case <-ticker.C:
+			if w.opts.Poll {
+				w.poll()
+			}
+			w.importSettled(time.Now())
+		}
+	}
+}
+
+// scan returns the state of all files in the watched directory.
+func (w *docWatcher) scan() (map[string]fileState, error) {
+	files := map[string]fileState{}
+	err := walkDocFiles(w.dir, w.opts.ImportDocsOpts, func(rel string, fi os.FileInfo) error {
+		files[rel] = newFileState(fi)
+		return nil
+	})
+
+	return files, err
+}
+
+// poll marks every new or changed file as pending.
+func (w *docWatcher) poll() {
+	files, err := w.scan()
+	if err != nil {
+		log.Println(err)
+		w.result.AddError("%v", err)
+		return
+	}
+
+	for rel, state := range files {
+		if _, ok := w.pending[rel]; ok {
+			continue
+		}
+		if seen, ok := w.seen[rel]; ok && seen == state {
+			continue
+		}
+		w.markPending(rel, state)
+	}
+}
+
+func (w *docWatcher) startNotify() error {
+	n, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	err = w.watchDir(n, w.dir)
+	if err != nil {
+		n.Close()
+		return err
+	}
+	w.notify = n
+
+	return nil
+}
+
+// watchDir adds dir and, when importing recursive, all accepted
+// subdirectories to the inotify watcher.
+func (w *docWatcher) watchDir(n *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+
+		if p != dir {
+			rel, err := w.rel(p)
+			if err != nil {
+				return err
+			}
+			if !w.opts.Recursive || !w.acceptPath(rel, true) {
+				return filepath.SkipDir
+			}
+		}
+
+		return n.Add(p)
+	})
+}
+
+func (w *docWatcher) handleEvent(ev fsnotify.Event) {
+	rel, err := w.rel(ev.Name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(w.pending, rel)
+		delete(w.seen, rel)
+		return
+	}
+
+	fi, err := os.Stat(ev.Name)
+	if err != nil {
+		// The file is already gone again
+		return
+	}
+
+	if fi.IsDir() {
+		if ev.Op&fsnotify.Create == 0 || !w.opts.Recursive || !w.acceptPath(rel, true) {
+			return
+		}
+
+		err := w.watchDir(w.notify, ev.Name)
+		if err != nil {
+			log.Println(err)
+			w.result.AddError("%v", err)
+		}
+
+		// Files could be written before the watch was added
+		w.poll()
+		return
+	}
+
+	if !fi.Mode().IsRegular() || !w.acceptPath(rel, false) {
+		return
+	}
+
+	w.markPending(rel, newFileState(fi))
+}
+
+func (w *docWatcher) markPending(rel string, state fileState) {
+	p, ok := w.pending[rel]
+	if ok && p.State == state {
+		return
+	}
+
+	w.pending[rel] = &pendingFile{
+		State:   state,
+		Changed: time.Now(),
+	}
+}
+
+// importSettled imports all pending files which did not change for the
+// settle time.
+func (w *docWatcher) importSettled(now time.Time) {
+	ready := []string{}
+	for rel, p := range w.pending {
+		fi, err := os.Stat(filepath.Join(w.dir, filepath.FromSlash(rel)))
+		if err != nil {
+			delete(w.pending, rel)
+			continue
+		}
+
+		state := newFileState(fi)
+		if state != p.State {
+			p.State = state
+			p.Changed = now
+			continue
+		}
+
+		if now.Sub(p.Changed) < w.opts.Settle {
+			continue
+		}
+
+		if seen, ok := w.seen[rel]; ok && seen == state {
+			delete(w.pending, rel)
+			continue
+		}
+
+		ready = append(ready, rel)
+	}
+
+	sort.Strings(ready)
+	for _, rel := range ready {
+		w.importFile(rel, now)
+	}
+}
+
+func (w *docWatcher) importFile(rel string, now time.Time) {
+	p := w.pending[rel]
+
+	files, invalid := applyInvalidNamePolicy(
+		[]docFile{w.opts.newDocFile(w.dir, rel)},
+		w.opts.OnInvalidName,
+	)
+	for _, f := range invalid {
+		log.Println(f.Name, f.Error)
+		w.result.Add("invalid", 1)
+		w.report.Invalid = append(w.report.Invalid, f)
+		fmt.Fprintf(w.opts.Progress, "! %v: %v (%v)\n", f.Name, f.Error, f.Action)
+	}
+
+	err := w.writeFiles(files)
+	if err != nil {
+		// Try again after the next settle time
+		log.Println(err)
+		w.result.AddError("%v: %v", rel, err)
+		fmt.Fprintf(w.opts.Progress, "! %v: %v\n", rel, err)
+		p.Changed = now
+		return
+	}
+
+	w.seen[rel] = p.State
+	delete(w.pending, rel)
+}
+
+func (w *docWatcher) writeFiles(files []docFile) error {
+	err := hashDocFiles(files)
+	if err != nil {
+		return err
+	}
+
+	files, dups, err := checkDuplicates(w.db, files, w.opts.OnDuplicate)
+	if err != nil {
+		return err
+	}
+	for _, d := range dups {
+		w.result.Add("duplicates", 1)
+		w.report.Duplicates = append(w.report.Duplicates, d)
+		fmt.Fprintf(w.opts.Progress, "= %v same as %v (%v)\n",
+			d.Name, strings.Join(d.Existing, ", "), d.Action)
+	}
+
+	missing := []string{}
+	for _, l := range fileLabels(files) {
+		if _, ok := w.labelIDs[l]; !ok {
+			missing = append(missing, l)
+		}
+	}
+	_, missing, err = checkLabels(w.db, missing, w.opts.CreateLabels)
+	if err != nil {
+		return err
+	}
+
+	err = writeDocsTx(w.db, files, w.labelIDs, missing)
+	if err != nil {
+		return err
+	}
+	w.report.NewLabels = append(w.report.NewLabels, missing...)
+
+	w.result.Add("docs", len(files))
+	for _, f := range files {
+		fmt.Fprintf(w.opts.Progress, "+ %v\n", f.Doc.Name)
+	}
+
+	return nil
+}
+
+func (w *docWatcher) rel(p string) (string, error) {
+	rel, err := filepath.Rel(w.dir, p)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// acceptPath checks the filters for rel and all its parent directories.
+func (w *docWatcher) acceptPath(rel string, isDir bool) bool {
+	parts := strings.Split(rel, "/")
+	if len(parts) > 1 && !w.opts.Recursive {
+		return false
+	}
+
+	for i := range parts[:len(parts)-1] {
+		if !w.opts.acceptDir(strings.Join(parts[:i+1], "/"), parts[i]) {
+			return false
+		}
+	}
+
+	name := parts[len(parts)-1]
+	if isDir {
+		return w.opts.acceptDir(rel, name)
+	}
+
+	return w.opts.acceptFile(rel, name)
+}
+
+func newFileState(fi os.FileInfo) fileState {
+	return fileState{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+}
@@ -0,0 +1,89 @@
+package cmds
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func Test_DocWatcher_Poll(t *testing.T) {
+	td, err := ioutil.TempDir(".", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	old := path.Join(td, "20140101_0000001.pdf")
+	err = ioutil.WriteFile(old, []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := NewResult()
+	w := &docWatcher{
+		dir:     td,
+		opts:    WatchOpts{ImportDocsOpts: ImportDocsOpts{Parser: DefaultParser{}}},
+		pending: map[string]*pendingFile{},
+		seen:    map[string]fileState{},
+		result:  &result,
+	}
+
+	files, err := w.scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rel, state := range files {
+		w.seen[rel] = state
+	}
+
+	err = ioutil.WriteFile(path.Join(td, "20140101_0000002.pdf"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path.Join(td, ".20140101_0000003.pdf"), []byte("hidden"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.poll()
+
+	if len(w.pending) != 1 {
+		t.Fatalf("Expect %v was %v", 1, len(w.pending))
+	}
+	if _, ok := w.pending["20140101_0000002.pdf"]; !ok {
+		t.Fatalf("Expect %v was %v", "20140101_0000002.pdf", w.pending)
+	}
+}
+
+func Test_DocWatcher_AcceptPath(t *testing.T) {
+	w := &docWatcher{
+		opts: WatchOpts{
+			ImportDocsOpts: ImportDocsOpts{
+				Recursive: true,
+				Include:   []string{"*.pdf"},
+				Exclude:   []string{"tmp"},
+			},
+		},
+	}
+
+	tests := map[string]bool{
+		"20140101_0000001.pdf":         true,
+		"2014/20140101_0000001.pdf":    true,
+		"2014/20140101_0000001.tmp":    false,
+		"tmp/20140101_0000001.pdf":     false,
+		".scans/20140101_0000001.pdf":  false,
+		"2014/.20140101_0000001.pdf":   false,
+		"2014/tmp/20140101_000001.pdf": false,
+	}
+	for rel, expect := range tests {
+		if r := w.acceptPath(rel, false); r != expect {
+			t.Fatalf("%v: Expect %v was %v", rel, expect, r)
+		}
+	}
+
+	w.opts.Recursive = false
+	if w.acceptPath("2014/20140101_0000001.pdf", false) {
+		t.Fatalf("Expect %v was %v", false, true)
+	}
+}